@@ -0,0 +1,152 @@
+package main
+
+import (
+  "encoding/json"
+  "errors"
+  "io/ioutil"
+  "log"
+  "net/http"
+)
+
+// Users can have several accounts with the broker (e.g. an IRA and a taxable
+// account). All of them are linked to the session and one is selected: it is
+// the account used by default.
+//
+// The handlers dealing with the cash, positions and orders take an optional
+// "account" query parameter to target another linked account.
+
+const kAccountQueryParam string = "account"
+
+// Returned when targeting an account that isn't linked to the session.
+var errUnknownAccount = errors.New("Unknown account")
+
+// Returns the IDs of the accounts linked to the session.
+func (s *Session) linkedAccountIds() []string {
+  // Sessions from before we supported multiple accounts only have the one.
+  if len(s.AccountIds) == 0 {
+    return []string{s.AccountId}
+  }
+  return s.AccountIds
+}
+
+func (s *Session) isLinked(accountId string) bool {
+  for _, linkedId := range s.linkedAccountIds() {
+    if linkedId == accountId {
+      return true
+    }
+  }
+  return false
+}
+
+// Returns the account targeted by |req|: the "account" query parameter if
+// set, the selected account otherwise.
+func (s *Session) requestAccountId(req *http.Request) (string, error) {
+  accountId := req.URL.Query().Get(kAccountQueryParam)
+  if accountId == "" {
+    return s.AccountId, nil
+  }
+  if !s.isLinked(accountId) {
+    return "", errUnknownAccount
+  }
+  return accountId, nil
+}
+
+// Returns the session of the user that made |req| and the account it targets.
+// The errors are written to |w|, in which case the session is nil.
+func getRequestAccount(w http.ResponseWriter, req *http.Request) (*Session, string) {
+  session, err := getLoginSession(req)
+  if err != nil {
+    http.Error(w, "Login required", http.StatusUnauthorized)
+    return nil, ""
+  }
+
+  accountId, err := session.requestAccountId(req)
+  if err != nil {
+    http.Error(w, "Unknown account", http.StatusBadRequest)
+    return nil, ""
+  }
+  return session, accountId
+}
+
+// Same as getRequestAccount for the handlers that don't require a login: the
+// session is nil and the account empty if the user isn't logged in.
+// Returns false if an error was written to |w|.
+func getOptionalRequestAccount(w http.ResponseWriter, req *http.Request) (*Session, string, bool) {
+  // We ignore err as it is logged by getLoginSession.
+  session, _ := getLoginSession(req)
+  if session == nil {
+    return nil, "", true
+  }
+
+  accountId, err := session.requestAccountId(req)
+  if err != nil {
+    http.Error(w, "Unknown account", http.StatusBadRequest)
+    return nil, "", false
+  }
+  return session, accountId, true
+}
+
+type accountsHandlerResponse struct {
+  Selected string `json:"selected"`
+  Accounts []string `json:"accounts"`
+}
+
+type selectAccountRequest struct {
+  AccountId string `json:"account_id"`
+}
+
+// GET returns the accounts linked to the session, PUT selects one of them.
+func accountsHandler(w http.ResponseWriter, req *http.Request) {
+  logRequest(req)
+
+  session, err := getLoginSession(req)
+  if err != nil {
+    http.Error(w, "Login required", http.StatusUnauthorized)
+    return
+  }
+
+  switch req.Method {
+  case http.MethodGet:
+  case http.MethodPut:
+    body, err := ioutil.ReadAll(req.Body)
+    if err != nil {
+      http.Error(w, "Couldn't read body", http.StatusBadRequest)
+      return
+    }
+
+    selectReq := selectAccountRequest{}
+    if err := json.Unmarshal(body, &selectReq); err != nil {
+      http.Error(w, "Invalid request", http.StatusBadRequest)
+      return
+    }
+    if !session.isLinked(selectReq.AccountId) {
+      http.Error(w, "Unknown account", http.StatusBadRequest)
+      return
+    }
+
+    if err := saveSessionAccount(session.Id, selectReq.AccountId); err != nil {
+      log.Printf("[ERROR] Failed to select the account (err = %+v)", err)
+      http.Error(w, "Internal Error", http.StatusInternalServerError)
+      return
+    }
+    session.AccountId = selectReq.AccountId
+  default:
+    http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    return
+  }
+
+  writeJSON(w, accountsHandlerResponse{
+    Selected: session.AccountId,
+    Accounts: session.linkedAccountIds(),
+  })
+}
+
+// Only updates the selected account so we don't overwrite a refreshed token.
+func saveSessionAccount(id, accountId string) error {
+  session, err := sessionStore.Get(id)
+  if err != nil {
+    return err
+  }
+  session.AccountId = accountId
+  return sessionStore.Put(id, session)
+}
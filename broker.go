@@ -0,0 +1,181 @@
+package main
+
+import (
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "log"
+  "net"
+  "net/http"
+  "strings"
+
+  "golang.org/x/oauth2"
+)
+
+// Returned by the account calls when the broker was created without a logged in user.
+var errNotLoggedIn = errors.New("Not logged in")
+
+// Broker abstracts the provider we get market data from and manage the account with.
+//
+// The handlers should only depend on this interface so we can swap providers
+// without touching them. The provider specific payloads are converted to our
+// own types (Quote, Option, UserAccountInfo) by the implementations.
+type Broker interface {
+  GetQuote(symbol string) (*Quote, error)
+  GetOptionChain(symbol, putCall string, params *ChainParams) ([]Option, error)
+
+  // The calls below require a logged in user.
+  // They return errNotLoggedIn if the broker was created without one.
+
+  // Returns the IDs of the accounts the user has access to.
+  GetAccountIds() ([]string, error)
+  GetUserAccountInfo(accountId string) (*UserAccountInfo, error)
+
+  // Sends |order| to the broker and returns its ID.
+  PlaceOrder(accountId string, order *Order) (string, error)
+  // Returns the orders entered recently, most recent first.
+  GetOrders(accountId string) ([]Order, error)
+  GetOrder(accountId, orderId string) (*Order, error)
+  CancelOrder(accountId, orderId string) error
+  // Replaces the order |orderId| with |order| and returns the new order's ID.
+  ReplaceOrder(accountId, orderId string, order *Order) (string, error)
+}
+
+// Values for AppSettings.Broker.
+const (
+  kBrokerTDA = "tda"
+  kBrokerSchwab = "schwab"
+)
+
+// Returns the broker configured in the settings.
+//
+// |client| is an authenticated client for the logged in user.
+// It can be nil if there is no such user.
+func newBroker(settings *AppSettings, client *http.Client) Broker {
+  switch settings.Broker {
+  case kBrokerSchwab:
+    return newSchwabBroker(settings, client)
+  default:
+    // TDA was the only broker before we added the setting.
+    return newTDABroker(settings, client)
+  }
+}
+
+// Returns the OAuth configuration for the broker configured in the settings.
+func newOAuthConfig(settings *AppSettings) *oauth2.Config {
+  switch settings.Broker {
+  case kBrokerSchwab:
+    return schwabOAuthConfig(settings)
+  default:
+    return tdaOAuthConfig(settings)
+  }
+}
+
+// Returns the broker for the user of |session|, nil if not logged in.
+func getBroker(settings *AppSettings, session *Session) Broker {
+  if session == nil {
+    return newBroker(settings, nil)
+  }
+
+  return newBroker(settings, newSessionClient(settings, session))
+}
+
+// Returned by doAuthenticatedRequest for non-2xx responses.
+type brokerStatusError struct {
+  StatusCode int
+}
+
+func (e *brokerStatusError) Error() string {
+  return fmt.Sprintf("Unexpected status %d from the broker", e.StatusCode)
+}
+
+// Whether |err| is the broker telling us the resource doesn't exist.
+func isNotFound(err error) bool {
+  var statusErr *brokerStatusError
+  return errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound
+}
+
+// Writes the error of a failed broker call to |w|. The user has to log in
+// again if the broker rejected the session's token.
+func writeBrokerError(w http.ResponseWriter, err error, action string) {
+  if errors.Is(err, errNotLoggedIn) {
+    http.Error(w, "Login required", http.StatusUnauthorized)
+    return
+  }
+  log.Printf("[ERROR] Failed to %s (err = %+v)", action, err)
+  http.Error(w, "Internal Error", http.StatusInternalServerError)
+}
+
+// Whether |err| could go away by retrying the call: network errors, rate
+// limiting and server errors.
+func isTransient(err error) bool {
+  var statusErr *brokerStatusError
+  if errors.As(err, &statusErr) {
+    return statusErr.StatusCode == http.StatusTooManyRequests || statusErr.StatusCode >= 500
+  }
+  var netErr net.Error
+  return errors.As(err, &netErr)
+}
+
+// Returns |rawURL| without its query for the logs: it can have the API key.
+func urlForLog(rawURL string) string {
+  path, _, _ := strings.Cut(rawURL, "?")
+  return path
+}
+
+// The longest part of a response body that we log.
+const kMaxLoggedBodySize = 200
+
+// Returns the start of |body| for the logs. The brokers' error messages fit
+// but the full bodies can have the account's data.
+func bodyForLog(body []byte) string {
+  if len(body) <= kMaxLoggedBodySize {
+    return string(body)
+  }
+  return fmt.Sprintf("%s... (%d bytes)", body[:kMaxLoggedBodySize], len(body))
+}
+
+// Performs an authenticated request with |body| marshalled as JSON (if not nil).
+// Returns the response along with its body.
+//
+// Non-2xx responses are returned as errors.
+func doAuthenticatedRequest(client *http.Client, method, url string, body any) (*http.Response, []byte, error) {
+  if client == nil {
+    return nil, nil, errNotLoggedIn
+  }
+
+  var reqBody io.Reader
+  if body != nil {
+    bytes, err := json.Marshal(body)
+    if err != nil {
+      return nil, nil, err
+    }
+    reqBody = strings.NewReader(string(bytes))
+  }
+
+  req, err := http.NewRequest(method, url, reqBody)
+  if err != nil {
+    return nil, nil, err
+  }
+  if body != nil {
+    req.Header.Add("Content-Type", "application/json")
+  }
+
+  resp, err := client.Do(req)
+  if err != nil {
+    return nil, nil, err
+  }
+  defer resp.Body.Close()
+  respBody, err := ioutil.ReadAll(resp.Body)
+  if err != nil {
+    return nil, nil, err
+  }
+
+  if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+    log.Printf("[ERROR] %s %s returned status %d: %s", method, urlForLog(url), resp.StatusCode, bodyForLog(respBody))
+    return nil, nil, &brokerStatusError{resp.StatusCode}
+  }
+  return resp, respBody, nil
+}
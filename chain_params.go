@@ -0,0 +1,230 @@
+package main
+
+import (
+  "encoding/json"
+  "fmt"
+  "io/ioutil"
+  "log"
+  "net/http"
+  "net/url"
+  "strconv"
+  "time"
+)
+
+// Values for ChainParams.Range, as defined by TDA and Schwab:
+// in/near/out-of-the-money, strikes above/below/near the market and all.
+var kChainRanges = map[string]bool{
+  "ITM": true,
+  "NTM": true,
+  "OTM": true,
+  "SAK": true,
+  "SBK": true,
+  "SNK": true,
+  "ALL": true,
+}
+
+// Values for ChainParams.Expirations.
+const (
+  kAllExpirations = "ALL"
+  // Only the standard monthly expirations (3rd Friday of the month).
+  kMonthlyExpirations = "MONTHLY"
+  // Only the non-monthly expirations.
+  kWeeklyExpirations = "WEEKLY"
+)
+
+// Which part of the option chain we request from the broker.
+type ChainParams struct {
+  MinDaysToExpiration int `json:"minDaysToExpiration"`
+  MaxDaysToExpiration int `json:"maxDaysToExpiration"`
+  // The number of strikes around the market price, 0 for all of them.
+  StrikeCount int `json:"strikeCount"`
+  // One of kChainRanges.
+  Range string `json:"range"`
+  // One of the k*Expirations.
+  Expirations string `json:"expirations"`
+}
+
+func defaultChainParams() *ChainParams {
+  return &ChainParams{
+    MinDaysToExpiration: 20,
+    MaxDaysToExpiration: 50,
+    StrikeCount: 5,
+    Range: "SBK",
+    Expirations: kAllExpirations,
+  }
+}
+
+// Returns the window of expiration dates to request.
+func (p *ChainParams) dateRange() (time.Time, time.Time) {
+  now := time.Now()
+  start := now.AddDate(/*years*/0, /*months*/0, p.MinDaysToExpiration)
+  end := now.AddDate(/*years*/0, /*months*/0, p.MaxDaysToExpiration)
+  return start, end
+}
+
+// Returns the date of Easter Sunday in |year| (Meeus/Jones/Butcher algorithm).
+func easterSunday(year int) time.Time {
+  a := year % 19
+  b := year / 100
+  c := year % 100
+  d := b / 4
+  e := b % 4
+  f := (b + 8) / 25
+  g := (b - f + 1) / 3
+  h := (19 * a + b - d - g + 15) % 30
+  i := c / 4
+  k := c % 4
+  l := (32 + 2 * e + 2 * i - h - k) % 7
+  m := (a + 11 * h + 22 * l) / 451
+  month := (h + l - 7 * m + 114) / 31
+  day := (h + l - 7 * m + 114) % 31 + 1
+  return time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.UTC)
+}
+
+// Returns true if the market is closed on |date| for a holiday that can fall
+// on a 3rd Friday: Good Friday and Juneteenth.
+func isThirdFridayHoliday(date time.Time) bool {
+  if date.Month() == time.June && date.Day() == 19 {
+    return true
+  }
+  goodFriday := easterSunday(date.Year()).AddDate(/*years*/0, /*months*/0, -2)
+  return date.Month() == goodFriday.Month() && date.Day() == goodFriday.Day()
+}
+
+// Returns true if |expiration| (YYYY-MM-DD) is the standard monthly
+// expiration: the 3rd Friday of its month, or the Thursday before when the
+// market is closed that Friday.
+// This is for the brokers that don't tell the expiration type.
+func isMonthlyExpiration(expiration string) bool {
+  date, err := time.Parse("2006-01-02", expiration)
+  if err != nil {
+    return false
+  }
+  switch date.Weekday() {
+  case time.Friday:
+    return date.Day() >= 15 && date.Day() <= 21 && !isThirdFridayHoliday(date)
+  case time.Thursday:
+    friday := date.AddDate(/*years*/0, /*months*/0, 1)
+    return friday.Day() >= 15 && friday.Day() <= 21 && isThirdFridayHoliday(friday)
+  default:
+    return false
+  }
+}
+
+// Returns true if |option|'s expiration is one we asked for.
+func (p *ChainParams) matchesExpiration(option Option) bool {
+  switch p.Expirations {
+  case kMonthlyExpirations:
+    return option.MonthlyExpiration
+  case kWeeklyExpirations:
+    return !option.MonthlyExpiration
+  default:
+    return true
+  }
+}
+
+func (p *ChainParams) validate() error {
+  if p.MinDaysToExpiration < 0 || p.MaxDaysToExpiration < p.MinDaysToExpiration {
+    return fmt.Errorf("Invalid days to expiration window: %d-%d", p.MinDaysToExpiration, p.MaxDaysToExpiration)
+  }
+  if p.StrikeCount < 0 {
+    return fmt.Errorf("Invalid strikeCount: %d", p.StrikeCount)
+  }
+  if !kChainRanges[p.Range] {
+    return fmt.Errorf("Invalid range: %s", p.Range)
+  }
+  switch p.Expirations {
+  case kAllExpirations, kMonthlyExpirations, kWeeklyExpirations:
+  default:
+    return fmt.Errorf("Invalid expirations: %s", p.Expirations)
+  }
+  return nil
+}
+
+// Overrides the parameters with the ones in |query|.
+func (p *ChainParams) applyQuery(query url.Values) error {
+  intParams := map[string]*int{
+    "min_dte": &p.MinDaysToExpiration,
+    "max_dte": &p.MaxDaysToExpiration,
+    "strike_count": &p.StrikeCount,
+  }
+  for name, field := range intParams {
+    if param := query.Get(name); param != "" {
+      value, err := strconv.Atoi(param)
+      if err != nil {
+        return fmt.Errorf("Invalid %s: %s", name, param)
+      }
+      *field = value
+    }
+  }
+
+  if param := query.Get("range"); param != "" {
+    p.Range = param
+  }
+  if param := query.Get("expirations"); param != "" {
+    p.Expirations = param
+  }
+
+  return p.validate()
+}
+
+// Returns the chain parameters for |req|: the user's |preferences| overridden
+// by the query parameters.
+func getRequestChainParams(req *http.Request, preferences *Preferences) (*ChainParams, error) {
+  params := preferences.chainParams()
+  if err := params.applyQuery(req.URL.Query()); err != nil {
+    return nil, err
+  }
+  return params, nil
+}
+
+// GET returns the chain parameters of the logged in user, PUT replaces them.
+// They are part of the user's preferences.
+func chainParamsHandler(w http.ResponseWriter, req *http.Request) {
+  logRequest(req)
+
+  session, err := getLoginSession(req)
+  if err != nil {
+    http.Error(w, "Login required", http.StatusUnauthorized)
+    return
+  }
+
+  switch req.Method {
+  case http.MethodGet:
+    preferences, err := getUserPreferences(session.userId())
+    if err != nil {
+      log.Printf("[ERROR] Failed to get the chain parameters (err = %+v)", err)
+      http.Error(w, "Internal Error", http.StatusInternalServerError)
+      return
+    }
+    writeJSON(w, preferences.chainParams())
+  case http.MethodPut:
+    body, err := ioutil.ReadAll(req.Body)
+    if err != nil {
+      http.Error(w, "Couldn't read body", http.StatusBadRequest)
+      return
+    }
+
+    params := defaultChainParams()
+    if err := json.Unmarshal(body, params); err != nil {
+      http.Error(w, "Invalid chain parameters", http.StatusBadRequest)
+      return
+    }
+    if err := params.validate(); err != nil {
+      http.Error(w, err.Error(), http.StatusBadRequest)
+      return
+    }
+
+    _, err = updateUserPreferences(session.userId(), func(preferences *Preferences) {
+      preferences.ChainParams = params
+    })
+    if err != nil {
+      log.Printf("[ERROR] Failed to save the chain parameters (err = %+v)", err)
+      http.Error(w, "Internal Error", http.StatusInternalServerError)
+      return
+    }
+    writeJSON(w, params)
+  default:
+    http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+  }
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+  "testing"
+)
+
+func TestIsMonthlyExpiration(t *testing.T) {
+  tests := []struct {
+    expiration string
+    monthly bool
+  }{
+    {"2024-05-17", true},
+    {"2024-05-10", false},
+    {"2024-05-24", false},
+    // Good Friday 2025 is the 3rd Friday of April, the monthlies expire the day before.
+    {"2025-04-17", true},
+    {"2025-04-18", false},
+    // Same for Juneteenth 2026.
+    {"2026-06-18", true},
+    {"2026-06-19", false},
+    // A regular Thursday.
+    {"2024-05-16", false},
+    {"invalid", false},
+  }
+  for _, test := range tests {
+    if monthly := isMonthlyExpiration(test.expiration); monthly != test.monthly {
+      t.Errorf("isMonthlyExpiration(%s) = %t, want %t", test.expiration, monthly, test.monthly)
+    }
+  }
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+  "errors"
+  "log"
+  "math"
+  "net/http"
+)
+
+// Covered calls are the second leg of the wheel: once a put is assigned, we
+// sell calls against the shares until they get called away.
+
+type coveredCallSuggestions struct {
+  Position Position `json:"position"`
+  Quote *Quote `json:"quote"`
+  // The shares not already covered by short calls or working call orders.
+  UncoveredShares float64 `json:"uncoveredShares"`
+  // The number of contracts the uncovered shares can cover.
+  Contracts int `json:"contracts"`
+  Suggestions []Option `json:"suggestions"`
+  // Set if we failed to get the options for this position.
+  Error string `json:"error,omitempty"`
+}
+
+type coveredCallsHandlerResponse struct {
+  Positions []coveredCallSuggestions `json:"positions"`
+}
+
+// Suggests covered calls for the stock positions of the logged in user.
+func coveredCallsHandler(w http.ResponseWriter, req *http.Request) {
+  logRequest(req)
+
+  session, accountId := getRequestAccount(w, req)
+  if session == nil {
+    return
+  }
+
+  preferences := getSessionPreferences(session)
+  params, err := getSuggestionParams(req, preferences)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusBadRequest)
+    return
+  }
+  chainParams, err := getRequestChainParams(req, preferences)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusBadRequest)
+    return
+  }
+
+  settings, err := getAppSettings()
+  if err != nil {
+    log.Printf("[ERROR] Failed getting the app settings (err = %+v)", err)
+    http.Error(w, "Internal Error", http.StatusInternalServerError)
+    return
+  }
+
+  broker := getBroker(settings, session)
+  userAccountInfo, err := broker.GetUserAccountInfo(accountId)
+  if err != nil {
+    writeBrokerError(w, err, "get user account info")
+    return
+  }
+
+  orders, err := broker.GetOrders(accountId)
+  if err != nil {
+    writeBrokerError(w, err, "get the orders")
+    return
+  }
+
+  positions := userAccountInfo.LongEquityPositions()
+  symbols := make([]string, 0, len(positions))
+  for _, position := range positions {
+    symbols = append(symbols, position.Symbol)
+  }
+
+  results := scanSymbols(broker, symbols, CALL, chainParams, settings.riskFreeRate())
+
+  resp := coveredCallsHandlerResponse{
+    Positions: make([]coveredCallSuggestions, 0, len(positions)),
+  }
+  for i, result := range results {
+    suggestions := coveredCallSuggestions{
+      Position: positions[i],
+      UncoveredShares: userAccountInfo.UncoveredShares(positions[i].Symbol, orders),
+      Suggestions: []Option{},
+    }
+
+    switch {
+    case errors.Is(result.err, errUnknownSymbol):
+      suggestions.Error = "Unknown symbol"
+    case result.err != nil:
+      log.Printf("[ERROR] Failed to get options for symbol %s (err = %+v)", result.symbol, result.err)
+      suggestions.Error = "Failed to get the options"
+    default:
+      suggestions.Quote = result.quote
+      suggestions.Suggestions = FilterCoveredCalls(positions[i], suggestions.UncoveredShares, result.options, params)
+      if len(result.options) > 0 && result.options[0].Multiplier > 0 {
+        suggestions.Contracts = int(math.Floor(suggestions.UncoveredShares / result.options[0].Multiplier))
+      }
+    }
+    resp.Positions = append(resp.Positions, suggestions)
+  }
+
+  writeJSON(w, resp)
+}
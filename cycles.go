@@ -0,0 +1,413 @@
+package main
+
+import (
+  "context"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io/ioutil"
+  "log"
+  "net/http"
+  "sync"
+  "time"
+
+  "cloud.google.com/go/datastore"
+)
+
+// A wheel cycle starts by selling a put on an underlying and ends when the put
+// expires worthless or, if it was assigned, when the shares are called away.
+// In between, calls are sold against the assigned shares.
+//
+// The cycles are stored in Datastore, alongside the settings. The cycles of
+// an account share a parent key so they can be updated in a transaction.
+const kCyclesTable string = "WheelCycle"
+const kCycleAccountsTable string = "WheelCycleAccount"
+
+// States of a cycle.
+const (
+  kCyclePutOpen = "PUT_OPEN"
+  kCycleSharesHeld = "SHARES_HELD"
+  kCycleCallOpen = "CALL_OPEN"
+  kCycleClosed = "CLOSED"
+)
+
+// Events recorded on a cycle.
+const (
+  kEventSellPut = "SELL_PUT"
+  kEventPutExpired = "PUT_EXPIRED"
+  kEventPutAssigned = "PUT_ASSIGNED"
+  kEventSellCall = "SELL_CALL"
+  kEventCallExpired = "CALL_EXPIRED"
+  kEventCalledAway = "CALLED_AWAY"
+)
+
+// The state a cycle must be in to accept an event, and the state it moves to.
+var kCycleTransitions = map[string]struct{ from, to string }{
+  kEventSellPut: {"", kCyclePutOpen},
+  kEventPutExpired: {kCyclePutOpen, kCycleClosed},
+  kEventPutAssigned: {kCyclePutOpen, kCycleSharesHeld},
+  kEventSellCall: {kCycleSharesHeld, kCycleCallOpen},
+  kEventCallExpired: {kCycleCallOpen, kCycleSharesHeld},
+  kEventCalledAway: {kCycleCallOpen, kCycleClosed},
+}
+
+type CycleEvent struct {
+  Type string `json:"type"`
+  // Date is YYYY-MM-DD. Defaults to today.
+  Date string `json:"date"`
+
+  // The option this event is about. For expirations and assignments, this
+  // defaults to the option that was sold.
+  OptionSymbol string `json:"optionSymbol"`
+  StrikePrice float64 `json:"strikePrice"`
+  Contracts int `json:"contracts"`
+  Multiplier float64 `json:"multiplier"`
+  // The premium received per share, only for sales.
+  Premium float64 `json:"premium"`
+}
+
+type WheelCycle struct {
+  Id int64 `json:"id" datastore:"-"`
+  AccountId string `json:"-"`
+  Underlying string `json:"underlying"`
+  State string `json:"state"`
+  Events []CycleEvent `json:"events" datastore:",noindex"`
+
+  // The fields below are computed from the events, see recompute.
+
+  // The premium collected on all the options sold.
+  RealisedPremium float64 `json:"realisedPremium" datastore:",noindex"`
+  SharesHeld float64 `json:"sharesHeld" datastore:",noindex"`
+  // The assignment price minus the premium collected, per share.
+  // Only set once the put is assigned.
+  AdjustedCostBasis float64 `json:"adjustedCostBasis" datastore:",noindex"`
+  // The profit (premium and capital gains) once the cycle is closed.
+  RealisedProfit float64 `json:"realisedProfit" datastore:",noindex"`
+}
+
+func (c *WheelCycle) recompute() {
+  var premium, assignedShares, assignmentCost, calledAwayShares, calledAwayProceeds float64
+  for _, event := range c.Events {
+    size := float64(event.Contracts) * event.Multiplier
+    switch event.Type {
+    case kEventSellPut, kEventSellCall:
+      premium += event.Premium * size
+    case kEventPutAssigned:
+      assignedShares += size
+      assignmentCost += event.StrikePrice * size
+    case kEventCalledAway:
+      calledAwayShares += size
+      calledAwayProceeds += event.StrikePrice * size
+    }
+  }
+
+  c.RealisedPremium = premium
+  c.SharesHeld = assignedShares - calledAwayShares
+  c.AdjustedCostBasis = 0
+  if assignedShares > 0 {
+    c.AdjustedCostBasis = (assignmentCost - premium) / assignedShares
+  }
+  c.RealisedProfit = 0
+  if c.State == kCycleClosed {
+    c.RealisedProfit = premium + calledAwayProceeds - assignmentCost
+  }
+}
+
+// Validates |event| and records it on the cycle.
+func (c *WheelCycle) apply(event CycleEvent) error {
+  transition, exists := kCycleTransitions[event.Type]
+  if !exists {
+    return fmt.Errorf("Unknown event type: %s", event.Type)
+  }
+  if c.State != transition.from {
+    return fmt.Errorf("Can't apply %s to a cycle in state %s", event.Type, c.State)
+  }
+
+  if event.Date == "" {
+    event.Date = time.Now().Format("2006-01-02")
+  }
+  if _, err := time.Parse("2006-01-02", event.Date); err != nil {
+    return fmt.Errorf("Invalid date: %s", event.Date)
+  }
+
+  switch event.Type {
+  case kEventSellPut, kEventSellCall:
+    if event.Contracts <= 0 || event.StrikePrice <= 0 || event.Premium < 0 {
+      return fmt.Errorf("%s requires contracts, strikePrice and premium", event.Type)
+    }
+    if event.Multiplier == 0 {
+      event.Multiplier = 100
+    }
+  default:
+    // Expirations and assignments are about the option we sold last.
+    sold := c.Events[len(c.Events) - 1]
+    event.OptionSymbol = sold.OptionSymbol
+    event.StrikePrice = sold.StrikePrice
+    event.Contracts = sold.Contracts
+    event.Multiplier = sold.Multiplier
+    event.Premium = 0
+  }
+
+  if event.Type == kEventSellCall && float64(event.Contracts) * event.Multiplier > c.SharesHeld {
+    return fmt.Errorf("Not enough shares to cover %d contracts", event.Contracts)
+  }
+
+  c.Events = append(c.Events, event)
+  c.State = transition.to
+  c.recompute()
+  // The cycle goes on if the calls didn't cover all the shares.
+  if event.Type == kEventCalledAway && c.SharesHeld > 0 {
+    c.State = kCycleSharesHeld
+    c.recompute()
+  }
+  return nil
+}
+
+// Storage
+
+type CycleStore interface {
+  // Returns the cycles of |accountId|.
+  List(accountId string) ([]*WheelCycle, error)
+  // Calls |update| with the cycles of |accountId| and saves the cycle it
+  // returns, atomically. |update| can be called more than once.
+  Update(accountId string, update func(cycles []*WheelCycle) (*WheelCycle, error)) (*WheelCycle, error)
+}
+
+// The store used by the handlers, see main.
+var cycleStore CycleStore = &datastoreCycleStore{}
+
+type datastoreCycleStore struct {}
+
+// The parent of all the cycles of |accountId|. The entity itself doesn't exist.
+func cyclesParentKey(accountId string) *datastore.Key {
+  return datastore.NameKey(kCycleAccountsTable, accountId, nil)
+}
+
+// Returns the cycles of |accountId|, read in |tx| if it isn't nil.
+func getCycles(ctx context.Context, client *datastore.Client, accountId string, tx *datastore.Transaction) ([]*WheelCycle, error) {
+  var cycles []*WheelCycle
+  q := datastore.NewQuery(kCyclesTable).Ancestor(cyclesParentKey(accountId))
+  if tx != nil {
+    q = q.Transaction(tx)
+  }
+  keys, err := client.GetAll(ctx, q, &cycles)
+  if err != nil {
+    return nil, err
+  }
+
+  for i, key := range keys {
+    cycles[i].Id = key.ID
+  }
+  return cycles, nil
+}
+
+func (s *datastoreCycleStore) List(accountId string) ([]*WheelCycle, error) {
+  ctx := context.Background()
+  client, err := getDatastoreClient()
+  if err != nil {
+    return nil, err
+  }
+
+  return getCycles(ctx, client, accountId, nil)
+}
+
+func (s *datastoreCycleStore) Update(accountId string, update func(cycles []*WheelCycle) (*WheelCycle, error)) (*WheelCycle, error) {
+  ctx := context.Background()
+  client, err := getDatastoreClient()
+  if err != nil {
+    return nil, err
+  }
+
+  var cycle *WheelCycle
+  var pendingKey *datastore.PendingKey
+  commit, err := client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+    cycles, err := getCycles(ctx, client, accountId, tx)
+    if err != nil {
+      return err
+    }
+    cycle, err = update(cycles)
+    if err != nil {
+      return err
+    }
+
+    key := datastore.IncompleteKey(kCyclesTable, cyclesParentKey(accountId))
+    if cycle.Id != 0 {
+      key = datastore.IDKey(kCyclesTable, cycle.Id, cyclesParentKey(accountId))
+    }
+    pendingKey, err = tx.Put(key, cycle)
+    return err
+  })
+  if err != nil {
+    return nil, err
+  }
+  cycle.Id = commit.Key(pendingKey).ID
+  return cycle, nil
+}
+
+// Keeps the cycles in memory. Used with the fake broker.
+type memoryCycleStore struct {
+  mutex sync.Mutex
+  lastId int64
+  cycles map[string][]WheelCycle
+}
+
+func newMemoryCycleStore() *memoryCycleStore {
+  return &memoryCycleStore{
+    cycles: make(map[string][]WheelCycle),
+  }
+}
+
+// Must be called with the mutex held.
+// The cycles are copied so the caller can't change the stored ones.
+func (s *memoryCycleStore) list(accountId string) []*WheelCycle {
+  cycles := make([]*WheelCycle, 0, len(s.cycles[accountId]))
+  for _, cycle := range s.cycles[accountId] {
+    cycle := cycle
+    cycle.Events = append([]CycleEvent{}, cycle.Events...)
+    cycles = append(cycles, &cycle)
+  }
+  return cycles
+}
+
+func (s *memoryCycleStore) List(accountId string) ([]*WheelCycle, error) {
+  s.mutex.Lock()
+  defer s.mutex.Unlock()
+
+  return s.list(accountId), nil
+}
+
+func (s *memoryCycleStore) Update(accountId string, update func(cycles []*WheelCycle) (*WheelCycle, error)) (*WheelCycle, error) {
+  s.mutex.Lock()
+  defer s.mutex.Unlock()
+
+  cycle, err := update(s.list(accountId))
+  if err != nil {
+    return nil, err
+  }
+
+  if cycle.Id == 0 {
+    s.lastId++
+    cycle.Id = s.lastId
+    s.cycles[accountId] = append(s.cycles[accountId], *cycle)
+    return cycle, nil
+  }
+  for i := range s.cycles[accountId] {
+    if s.cycles[accountId][i].Id == cycle.Id {
+      s.cycles[accountId][i] = *cycle
+    }
+  }
+  return cycle, nil
+}
+
+// Records |event| on the open cycle for |underlying|, creating one if needed.
+// This is done atomically so concurrent events can't both be applied to the
+// same state, or both create a cycle.
+func recordCycleEvent(accountId, underlying string, event CycleEvent) (*WheelCycle, error) {
+  return cycleStore.Update(accountId, func(cycles []*WheelCycle) (*WheelCycle, error) {
+    var cycle *WheelCycle
+    for _, c := range cycles {
+      if c.Underlying == underlying && c.State != kCycleClosed {
+        cycle = c
+        break
+      }
+    }
+
+    if cycle == nil {
+      cycle = &WheelCycle{
+        AccountId: accountId,
+        Underlying: underlying,
+        Events: []CycleEvent{},
+      }
+    }
+    if err := cycle.apply(event); err != nil {
+      return nil, &cycleEventError{err}
+    }
+    return cycle, nil
+  })
+}
+
+// Wraps the errors caused by an invalid event.
+type cycleEventError struct {
+  err error
+}
+
+func (e *cycleEventError) Error() string {
+  return e.err.Error()
+}
+
+// Handler
+
+type cycleEventRequest struct {
+  Underlying string `json:"underlying"`
+  Event CycleEvent `json:"event"`
+}
+
+type cyclesHandlerResponse struct {
+  Cycles []*WheelCycle `json:"cycles"`
+}
+
+// GET returns the cycles of the account, optionally filtered by |underlying|.
+// POST records an event on the open cycle for an underlying.
+// The account is the one in the |account| parameter or the selected one.
+func cyclesHandler(w http.ResponseWriter, req *http.Request) {
+  logRequest(req)
+
+  session, accountId := getRequestAccount(w, req)
+  if session == nil {
+    return
+  }
+
+  switch req.Method {
+  case http.MethodGet:
+    cycles, err := cycleStore.List(accountId)
+    if err != nil {
+      log.Printf("[ERROR] Failed to get the cycles (err = %+v)", err)
+      http.Error(w, "Internal Error", http.StatusInternalServerError)
+      return
+    }
+
+    resp := cyclesHandlerResponse{
+      Cycles: []*WheelCycle{},
+    }
+    underlying := req.URL.Query().Get("underlying")
+    for _, cycle := range cycles {
+      if underlying == "" || cycle.Underlying == underlying {
+        resp.Cycles = append(resp.Cycles, cycle)
+      }
+    }
+    writeJSON(w, resp)
+  case http.MethodPost:
+    body, err := ioutil.ReadAll(req.Body)
+    if err != nil {
+      http.Error(w, "Couldn't read body", http.StatusBadRequest)
+      return
+    }
+
+    var eventReq cycleEventRequest
+    if err := json.Unmarshal(body, &eventReq); err != nil {
+      http.Error(w, "Invalid event", http.StatusBadRequest)
+      return
+    }
+
+    underlying, valid := normalizeSymbol(eventReq.Underlying)
+    if !valid {
+      http.Error(w, "Invalid underlying", http.StatusBadRequest)
+      return
+    }
+
+    cycle, err := recordCycleEvent(accountId, underlying, eventReq.Event)
+    var eventErr *cycleEventError
+    if errors.As(err, &eventErr) {
+      http.Error(w, eventErr.Error(), http.StatusBadRequest)
+      return
+    }
+    if err != nil {
+      log.Printf("[ERROR] Failed to record the cycle event (err = %+v)", err)
+      http.Error(w, "Internal Error", http.StatusInternalServerError)
+      return
+    }
+    writeJSON(w, cycle)
+  default:
+    http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+  }
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+  "math"
+  "testing"
+)
+
+func sellPut(contracts int, strike, premium float64) CycleEvent {
+  return CycleEvent{Type: kEventSellPut, Date: "2024-05-01", StrikePrice: strike, Contracts: contracts, Premium: premium}
+}
+
+func sellCall(contracts int, strike, premium float64) CycleEvent {
+  return CycleEvent{Type: kEventSellCall, Date: "2024-05-20", StrikePrice: strike, Contracts: contracts, Premium: premium}
+}
+
+func cycleEvent(eventType string) CycleEvent {
+  return CycleEvent{Type: eventType, Date: "2024-05-17"}
+}
+
+func TestWheelCycleApply(t *testing.T) {
+  tests := []struct {
+    name string
+    events []CycleEvent
+    state string
+    premium float64
+    sharesHeld float64
+    costBasis float64
+    profit float64
+  }{
+    {
+      name: "put expired",
+      events: []CycleEvent{sellPut(1, 50, 1), cycleEvent(kEventPutExpired)},
+      state: kCycleClosed,
+      premium: 100,
+      profit: 100,
+    },
+    {
+      name: "put assigned",
+      events: []CycleEvent{sellPut(1, 50, 1), cycleEvent(kEventPutAssigned)},
+      state: kCycleSharesHeld,
+      premium: 100,
+      sharesHeld: 100,
+      costBasis: 49,
+    },
+    {
+      name: "call expired",
+      events: []CycleEvent{sellPut(1, 50, 1), cycleEvent(kEventPutAssigned), sellCall(1, 52, 0.5), cycleEvent(kEventCallExpired)},
+      state: kCycleSharesHeld,
+      premium: 150,
+      sharesHeld: 100,
+      costBasis: 48.5,
+    },
+    {
+      name: "called away",
+      events: []CycleEvent{sellPut(1, 50, 1), cycleEvent(kEventPutAssigned), sellCall(1, 52, 0.5), cycleEvent(kEventCalledAway)},
+      state: kCycleClosed,
+      premium: 150,
+      costBasis: 48.5,
+      // The premium plus the $2 per share gained on the stock.
+      profit: 350,
+    },
+    {
+      // The call only covered half the shares so the cycle goes on.
+      name: "partially called away",
+      events: []CycleEvent{sellPut(2, 50, 1), cycleEvent(kEventPutAssigned), sellCall(1, 52, 0.5), cycleEvent(kEventCalledAway)},
+      state: kCycleSharesHeld,
+      premium: 250,
+      sharesHeld: 100,
+      costBasis: 48.75,
+    },
+    {
+      name: "called away in two parts",
+      events: []CycleEvent{
+        sellPut(2, 50, 1), cycleEvent(kEventPutAssigned),
+        sellCall(1, 52, 0.5), cycleEvent(kEventCalledAway),
+        sellCall(1, 51, 0.4), cycleEvent(kEventCalledAway),
+      },
+      state: kCycleClosed,
+      premium: 290,
+      costBasis: 48.55,
+      profit: 290 + 5200 + 5100 - 10000,
+    },
+  }
+
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      cycle := &WheelCycle{Underlying: "WY"}
+      for _, event := range test.events {
+        if err := cycle.apply(event); err != nil {
+          t.Fatalf("apply(%s) failed: %v", event.Type, err)
+        }
+      }
+
+      if cycle.State != test.state {
+        t.Errorf("State = %s, want %s", cycle.State, test.state)
+      }
+      values := []struct {
+        name string
+        got, want float64
+      }{
+        {"RealisedPremium", cycle.RealisedPremium, test.premium},
+        {"SharesHeld", cycle.SharesHeld, test.sharesHeld},
+        {"AdjustedCostBasis", cycle.AdjustedCostBasis, test.costBasis},
+        {"RealisedProfit", cycle.RealisedProfit, test.profit},
+      }
+      for _, value := range values {
+        if math.Abs(value.got - value.want) > 1e-9 {
+          t.Errorf("%s = %v, want %v", value.name, value.got, value.want)
+        }
+      }
+    })
+  }
+}
+
+func TestWheelCycleApplyInvalid(t *testing.T) {
+  tests := []struct {
+    name string
+    // Applied before |event|, they must succeed.
+    events []CycleEvent
+    event CycleEvent
+  }{
+    {"unknown event", nil, cycleEvent("SELL_STRADDLE")},
+    {"expiration without a put", nil, cycleEvent(kEventPutExpired)},
+    {"call without shares", nil, sellCall(1, 52, 0.5)},
+    {"second put", []CycleEvent{sellPut(1, 50, 1)}, sellPut(1, 48, 1)},
+    {"call on an open put", []CycleEvent{sellPut(1, 50, 1)}, sellCall(1, 52, 0.5)},
+    {"call expired without a call", []CycleEvent{sellPut(1, 50, 1), cycleEvent(kEventPutAssigned)}, cycleEvent(kEventCallExpired)},
+    {"called away without a call", []CycleEvent{sellPut(1, 50, 1), cycleEvent(kEventPutAssigned)}, cycleEvent(kEventCalledAway)},
+    {"put expired after assignment", []CycleEvent{sellPut(1, 50, 1), cycleEvent(kEventPutAssigned)}, cycleEvent(kEventPutExpired)},
+    {"event on a closed cycle", []CycleEvent{sellPut(1, 50, 1), cycleEvent(kEventPutExpired)}, sellPut(1, 50, 1)},
+    {"uncovered call", []CycleEvent{sellPut(1, 50, 1), cycleEvent(kEventPutAssigned)}, sellCall(2, 52, 0.5)},
+    {"put without contracts", nil, sellPut(0, 50, 1)},
+    {"put without strike", nil, sellPut(1, 0, 1)},
+    {"negative premium", nil, sellPut(1, 50, -1)},
+    {"invalid date", nil, CycleEvent{Type: kEventSellPut, Date: "05/01/2024", StrikePrice: 50, Contracts: 1, Premium: 1}},
+  }
+
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      cycle := &WheelCycle{Underlying: "WY"}
+      for _, event := range test.events {
+        if err := cycle.apply(event); err != nil {
+          t.Fatalf("apply(%s) failed: %v", event.Type, err)
+        }
+      }
+      state, eventCount := cycle.State, len(cycle.Events)
+
+      if err := cycle.apply(test.event); err == nil {
+        t.Errorf("apply(%s) succeeded in state %q", test.event.Type, state)
+      }
+      if cycle.State != state || len(cycle.Events) != eventCount {
+        t.Errorf("The rejected event changed the cycle: state %q, %d events", cycle.State, len(cycle.Events))
+      }
+    })
+  }
+}
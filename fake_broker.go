@@ -0,0 +1,602 @@
+package main
+
+import (
+  "crypto/sha256"
+  "encoding/base64"
+  "encoding/json"
+  "fmt"
+  "io/ioutil"
+  "log"
+  "net/http"
+  "net/url"
+  "os"
+  "path/filepath"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+// The fake broker serves a TDAmeritrade compatible API from JSON fixtures.
+// This allows running the whole app offline, including the OAuth dance. In
+// this mode, the app keeps its sessions, entities and cycles in memory
+// instead of Datastore (see main).
+//
+// The fixtures directory is laid out as:
+//   quotes/<SYMBOL>.json: the response to /marketdata/<SYMBOL>/quotes.
+//   chains/<SYMBOL>.json: the response to /marketdata/chains for <SYMBOL>.
+//   accounts.json: the response to /accounts.
+//
+// Orders are kept in memory. They fill if their price crosses the option's
+// Mark, otherwise they stay working until cancelled or replaced. The options
+// sold by the filled orders are added to the account's positions.
+//
+// The authorization codes are single use. If the login sent a PKCE challenge,
+// the token exchange must send the matching verifier.
+//
+// The expirations in the chains are relative to today: only the days to
+// expiration in the "YYYY-MM-DD:DTE" keys is used and the date (and the
+// option symbols) are recomputed. The same goes for the option positions in
+// accounts.json, using the "daysToExpiration" of their instrument. This way
+// the fixtures don't go stale.
+
+const kFakeBrokerPath string = "/fake-broker"
+
+const (
+  kFakeBrokerAccessToken = "fake-access-token"
+  kFakeBrokerRefreshToken = "fake-refresh-token"
+)
+
+// Set when running with -fake-broker, see getAppSettings.
+var fakeBrokerSettings *AppSettings
+
+type fakeBroker struct {
+  fixturesDir string
+
+  // Protects the fields below.
+  mutex sync.Mutex
+  nextOrderId int64
+  // The orders placed, per account.
+  orders map[string][]*tdaOrder
+  nextAuthCode int64
+  // The PKCE challenge for the codes not exchanged yet ("" if none was sent).
+  authCodes map[string]string
+}
+
+// Registers the fake broker's handlers and returns the settings to talk to it.
+// |serverURL| is the URL of this server, e.g. http://localhost:8080.
+func registerFakeBroker(mux *http.ServeMux, fixturesDir, serverURL string) *AppSettings {
+  f := &fakeBroker{
+    fixturesDir: fixturesDir,
+    nextOrderId: 1000,
+    orders: make(map[string][]*tdaOrder),
+    authCodes: make(map[string]string),
+  }
+  mux.HandleFunc(kFakeBrokerPath + "/auth", f.authHandler)
+  mux.HandleFunc(kFakeBrokerPath + "/v1/oauth2/token", f.tokenHandler)
+  mux.HandleFunc(kFakeBrokerPath + "/v1/marketdata/", f.marketDataHandler)
+  mux.HandleFunc(kFakeBrokerPath + "/v1/accounts", f.accountsHandler)
+  mux.HandleFunc(kFakeBrokerPath + "/v1/accounts/", f.accountsHandler)
+
+  baseURL := serverURL + kFakeBrokerPath
+  return &AppSettings{
+    Broker: kBrokerTDA,
+    TDAClientId: "FAKE",
+    TDARedirectURL: serverURL + "/oauth/redirect",
+    APIBaseURL: baseURL + "/v1",
+    AuthURL: baseURL + "/auth",
+    TokenURL: baseURL + "/v1/oauth2/token",
+    UsePKCE: true,
+  }
+}
+
+func (f *fakeBroker) readFixture(name string) ([]byte, error) {
+  return ioutil.ReadFile(filepath.Join(f.fixturesDir, name))
+}
+
+func writeFakeJSON(w http.ResponseWriter, body []byte) {
+  w.Header().Add("Content-Type", "application/json")
+  w.Write(body)
+}
+
+func (f *fakeBroker) isAuthorized(req *http.Request) bool {
+  return req.Header.Get("Authorization") == "Bearer " + kFakeBrokerAccessToken
+}
+
+// Immediately grants the authorization and redirects back to the app.
+func (f *fakeBroker) authHandler(w http.ResponseWriter, req *http.Request) {
+  logRequest(req)
+
+  query := req.URL.Query()
+  redirectURL, err := url.Parse(query.Get("redirect_uri"))
+  if err != nil || redirectURL.String() == "" {
+    http.Error(w, "Invalid redirect_uri", http.StatusBadRequest)
+    return
+  }
+
+  challenge := query.Get("code_challenge")
+  if challenge != "" && query.Get("code_challenge_method") != "S256" {
+    http.Error(w, "Unsupported code_challenge_method", http.StatusBadRequest)
+    return
+  }
+
+  f.mutex.Lock()
+  f.nextAuthCode++
+  code := fmt.Sprintf("fake-auth-code-%d", f.nextAuthCode)
+  f.authCodes[code] = challenge
+  f.mutex.Unlock()
+
+  redirectQuery := redirectURL.Query()
+  redirectQuery.Set("code", code)
+  redirectQuery.Set("state", query.Get("state"))
+  redirectURL.RawQuery = redirectQuery.Encode()
+  http.Redirect(w, req, redirectURL.String(), http.StatusFound)
+}
+
+func (f *fakeBroker) tokenHandler(w http.ResponseWriter, req *http.Request) {
+  logRequest(req)
+
+  if err := req.ParseForm(); err != nil {
+    http.Error(w, "Invalid form", http.StatusBadRequest)
+    return
+  }
+
+  switch req.PostForm.Get("grant_type") {
+  case "authorization_code":
+    if !f.redeemAuthCode(req.PostForm.Get("code"), req.PostForm.Get("code_verifier")) {
+      http.Error(w, "Invalid code", http.StatusBadRequest)
+      return
+    }
+  case "refresh_token":
+    if req.PostForm.Get("refresh_token") != kFakeBrokerRefreshToken {
+      http.Error(w, "Invalid refresh token", http.StatusBadRequest)
+      return
+    }
+  default:
+    http.Error(w, "Unsupported grant_type", http.StatusBadRequest)
+    return
+  }
+
+  body, err := json.Marshal(map[string]any{
+    "access_token": kFakeBrokerAccessToken,
+    "refresh_token": kFakeBrokerRefreshToken,
+    "token_type": "Bearer",
+    "expires_in": 1800,
+  })
+  if err != nil {
+    http.Error(w, "Internal Error", http.StatusInternalServerError)
+    return
+  }
+  writeFakeJSON(w, body)
+}
+
+// Whether |code| was issued and |verifier| matches its PKCE challenge.
+// The code can't be used again.
+func (f *fakeBroker) redeemAuthCode(code, verifier string) bool {
+  f.mutex.Lock()
+  defer f.mutex.Unlock()
+
+  challenge, exists := f.authCodes[code]
+  if !exists {
+    return false
+  }
+  delete(f.authCodes, code)
+
+  if challenge == "" {
+    return true
+  }
+  hash := sha256.Sum256([]byte(verifier))
+  return base64.RawURLEncoding.EncodeToString(hash[:]) == challenge
+}
+
+func (f *fakeBroker) marketDataHandler(w http.ResponseWriter, req *http.Request) {
+  logRequest(req)
+
+  path := strings.TrimPrefix(req.URL.Path, kFakeBrokerPath + "/v1/marketdata/")
+  if path == "chains" {
+    f.chainsHandler(w, req)
+    return
+  }
+
+  symbol, suffix, found := strings.Cut(path, "/")
+  if !found || suffix != "quotes" {
+    http.NotFound(w, req)
+    return
+  }
+
+  body, err := f.readFixture(filepath.Join("quotes", filepath.Base(symbol) + ".json"))
+  if os.IsNotExist(err) {
+    // TDA returns an empty object for unknown symbols.
+    writeFakeJSON(w, []byte("{}"))
+    return
+  }
+  if err != nil {
+    log.Printf("[ERROR] Failed to read the quote fixture for %s (err = %+v)", symbol, err)
+    http.Error(w, "Internal Error", http.StatusInternalServerError)
+    return
+  }
+  writeFakeJSON(w, body)
+}
+
+// Returns the TDA symbol for an option, e.g. WY_081922P32.
+func tdaOptionSymbol(underlying string, expiration time.Time, putCall string, strike float64) string {
+  return fmt.Sprintf("%s_%s%c%g", underlying, expiration.Format("010206"), putCall[0], strike)
+}
+
+// Returns the dates in |dateMap| relative to |now|, dropping the ones outside [from, to].
+func rebaseFakeDateMap(underlying string, dateMap tdaOptionByDateMap, now, from, to time.Time) tdaOptionByDateMap {
+  rebased := make(tdaOptionByDateMap, len(dateMap))
+  for key, optionsByPrice := range dateMap {
+    _, dteStr, _ := strings.Cut(key, ":")
+    dte, err := strconv.Atoi(dteStr)
+    if err != nil {
+      log.Printf("[WARN] Ignoring invalid expiration in fixture: %s", key)
+      continue
+    }
+
+    expiration := now.AddDate(/*years*/0, /*months*/0, dte)
+    if expiration.Before(from) || expiration.After(to) {
+      continue
+    }
+
+    for _, options := range optionsByPrice {
+      for i := range options {
+        options[i].DaysToExpiration = dte
+        options[i].Symbol = tdaOptionSymbol(underlying, expiration, options[i].PutCall, options[i].StrikePrice)
+      }
+    }
+    rebased[fmt.Sprintf("%s:%d", expiration.Format("2006-01-02"), dte)] = optionsByPrice
+  }
+  return rebased
+}
+
+func countFakeOptions(dateMap tdaOptionByDateMap) int {
+  count := 0
+  for _, optionsByPrice := range dateMap {
+    count += len(optionsByPrice)
+  }
+  return count
+}
+
+// Returns the chain fixture for |symbol|, before rebasing.
+func (f *fakeBroker) readChain(symbol string) (*tdaOptionChainResponse, error) {
+  body, err := f.readFixture(filepath.Join("chains", filepath.Base(symbol) + ".json"))
+  if err != nil {
+    return nil, err
+  }
+
+  chain := new(tdaOptionChainResponse)
+  if err := json.Unmarshal(body, chain); err != nil {
+    return nil, fmt.Errorf("Invalid chain fixture for %s: %w", symbol, err)
+  }
+  return chain, nil
+}
+
+func (f *fakeBroker) chainsHandler(w http.ResponseWriter, req *http.Request) {
+  query := req.URL.Query()
+  symbol := query.Get("symbol")
+
+  chain, err := f.readChain(symbol)
+  if os.IsNotExist(err) {
+    writeFakeJSON(w, []byte(`{"symbol":"` + symbol + `","status":"FAILED"}`))
+    return
+  }
+  if err != nil {
+    log.Printf("[ERROR] Failed to read the chain fixture for %s (err = %+v)", symbol, err)
+    http.Error(w, "Internal Error", http.StatusInternalServerError)
+    return
+  }
+
+  // Missing or invalid dates mean no bound, like TDA.
+  now := time.Now()
+  from, err := time.Parse("2006-1-2", query.Get("fromDate"))
+  if err != nil {
+    from = now
+  }
+  to, err := time.Parse("2006-1-2", query.Get("toDate"))
+  if err != nil {
+    to = now.AddDate(/*years*/10, /*months*/0, /*days*/0)
+  }
+  // Include the whole end day.
+  to = to.AddDate(/*years*/0, /*months*/0, /*days*/1)
+
+  chain.PutExpDateMap = rebaseFakeDateMap(chain.Symbol, chain.PutExpDateMap, now, from, to)
+  chain.CallExpDateMap = rebaseFakeDateMap(chain.Symbol, chain.CallExpDateMap, now, from, to)
+  switch query.Get("contractType") {
+  case PUT:
+    chain.CallExpDateMap = tdaOptionByDateMap{}
+  case CALL:
+    chain.PutExpDateMap = tdaOptionByDateMap{}
+  }
+  chain.NumberOfContracts = countFakeOptions(chain.PutExpDateMap) + countFakeOptions(chain.CallExpDateMap)
+
+  body, err := json.Marshal(chain)
+  if err != nil {
+    http.Error(w, "Internal Error", http.StatusInternalServerError)
+    return
+  }
+  writeFakeJSON(w, body)
+}
+
+// Returns the Mark of the option |symbol| in the chain fixtures.
+func (f *fakeBroker) optionMark(symbol string) (float64, bool) {
+  details, err := parseOptionSymbol(symbol)
+  if err != nil {
+    return 0, false
+  }
+  chain, err := f.readChain(details.Underlying)
+  if err != nil {
+    return 0, false
+  }
+
+  now := time.Now()
+  dateMap := chain.PutExpDateMap
+  if details.PutCall == CALL {
+    dateMap = chain.CallExpDateMap
+  }
+  dateMap = rebaseFakeDateMap(chain.Symbol, dateMap, now, now, now.AddDate(/*years*/10, /*months*/0, /*days*/0))
+  for _, optionsByPrice := range dateMap {
+    for _, options := range optionsByPrice {
+      for _, option := range options {
+        if option.Symbol == symbol {
+          return option.Mark, true
+        }
+      }
+    }
+  }
+  return 0, false
+}
+
+// Fills |order| if its price crosses the option's Mark.
+// The fixtures don't move so this is only checked when the order is entered.
+func (f *fakeBroker) maybeFillOrder(order *tdaOrder) {
+  leg := order.OrderLegCollection[0]
+  mark, found := f.optionMark(leg.Instrument.Symbol)
+  if !found {
+    return
+  }
+
+  selling := strings.HasPrefix(leg.Instruction, "SELL")
+  if (selling && order.Price <= mark) || (!selling && order.Price >= mark) {
+    order.Status = kOrderFilled
+    order.FilledQuantity = leg.Quantity
+  }
+}
+
+func (f *fakeBroker) accountsHandler(w http.ResponseWriter, req *http.Request) {
+  logRequest(req)
+
+  if !f.isAuthorized(req) {
+    http.Error(w, "Unauthorized", http.StatusUnauthorized)
+    return
+  }
+
+  accounts, err := f.readAccounts()
+  if err != nil {
+    log.Printf("[ERROR] Failed to read the accounts fixture (err = %+v)", err)
+    http.Error(w, "Internal Error", http.StatusInternalServerError)
+    return
+  }
+
+  accountId := strings.TrimPrefix(req.URL.Path, kFakeBrokerPath + "/v1/accounts")
+  accountId = strings.TrimPrefix(accountId, "/")
+  accountId, ordersPath, isOrders := strings.Cut(accountId, "/orders")
+  if isOrders {
+    f.ordersHandler(w, req, accountId, strings.TrimPrefix(ordersPath, "/"))
+    return
+  }
+  if accountId == "" {
+    writeJSON(w, accounts)
+    return
+  }
+
+  for _, account := range accounts {
+    var parsed tdaAccountInfoResponse
+    if err := json.Unmarshal(account, &parsed); err != nil {
+      continue
+    }
+    if parsed.SecuritiesAccount.AccountId == accountId {
+      account, err := f.addFilledPositions(accountId, account)
+      if err != nil {
+        log.Printf("[ERROR] Failed to add the filled orders to the positions (err = %+v)", err)
+        http.Error(w, "Internal Error", http.StatusInternalServerError)
+        return
+      }
+      writeFakeJSON(w, account)
+      return
+    }
+  }
+  http.NotFound(w, req)
+}
+
+// Returns the accounts in the fixture, with the option positions expiring
+// relative to today.
+// The raw JSON is kept so we return all the fields in the fixture.
+func (f *fakeBroker) readAccounts() ([]json.RawMessage, error) {
+  body, err := f.readFixture("accounts.json")
+  if err != nil {
+    return nil, err
+  }
+
+  var accounts []json.RawMessage
+  if err := json.Unmarshal(body, &accounts); err != nil {
+    return nil, fmt.Errorf("Invalid accounts fixture: %w", err)
+  }
+  for i := range accounts {
+    accounts[i], err = rebaseFakePositions(accounts[i], time.Now())
+    if err != nil {
+      return nil, err
+    }
+  }
+  return accounts, nil
+}
+
+// Recomputes the symbols and descriptions of the option positions in |account| that have a
+// "daysToExpiration" so they expire that many days after |now|.
+func rebaseFakePositions(account json.RawMessage, now time.Time) (json.RawMessage, error) {
+  // Go through a map so we keep the fields we don't parse.
+  var parsed map[string]map[string]any
+  if err := json.Unmarshal(account, &parsed); err != nil {
+    return nil, err
+  }
+
+  positions, _ := parsed["securitiesAccount"]["positions"].([]any)
+  for _, position := range positions {
+    instrument, _ := position.(map[string]any)["instrument"].(map[string]any)
+    dte, hasDTE := instrument["daysToExpiration"].(float64)
+    symbol, _ := instrument["symbol"].(string)
+    if !hasDTE {
+      continue
+    }
+    details, err := parseOptionSymbol(symbol)
+    if err != nil {
+      return nil, fmt.Errorf("Invalid option position in fixture: %w", err)
+    }
+    expiration := now.AddDate(/*years*/0, /*months*/0, int(dte))
+    instrument["symbol"] = tdaOptionSymbol(details.Underlying, expiration, details.PutCall, details.StrikePrice)
+    instrument["description"] = fmt.Sprintf("%s %s %.1f %s", details.Underlying,
+      expiration.Format("Jan 2 2006"), details.StrikePrice, details.PutCall[:1] + strings.ToLower(details.PutCall[1:]))
+  }
+  return json.Marshal(parsed)
+}
+
+// Adds the options sold by the filled orders to the positions of |account|.
+// The balances are left untouched.
+func (f *fakeBroker) addFilledPositions(accountId string, account json.RawMessage) (json.RawMessage, error) {
+  f.mutex.Lock()
+  defer f.mutex.Unlock()
+
+  positions := []tdaPosition{}
+  for _, order := range f.orders[accountId] {
+    leg := order.OrderLegCollection[0]
+    if order.Status != kOrderFilled || leg.Instruction != kSellToOpen {
+      continue
+    }
+    positions = append(positions, tdaPosition{
+      ShortQuantity: order.FilledQuantity,
+      AveragePrice: order.Price,
+      MarketValue: -order.Price * order.FilledQuantity * 100,
+      Instrument: tdaInstrument{
+        AssetType: kAssetTypeOption,
+        Symbol: leg.Instrument.Symbol,
+      },
+    })
+  }
+  if len(positions) == 0 {
+    return account, nil
+  }
+
+  // Go through a map so we keep the fields we don't parse.
+  var parsed map[string]map[string]any
+  if err := json.Unmarshal(account, &parsed); err != nil {
+    return nil, err
+  }
+  securitiesAccount := parsed["securitiesAccount"]
+  existing, _ := securitiesAccount["positions"].([]any)
+  for _, position := range positions {
+    existing = append(existing, position)
+  }
+  securitiesAccount["positions"] = existing
+  return json.Marshal(parsed)
+}
+
+// Returns the order |orderId| of |accountId|, nil if there is no such order.
+// Must be called with the mutex held.
+func (f *fakeBroker) findOrder(accountId, orderId string) *tdaOrder {
+  for _, order := range f.orders[accountId] {
+    if strconv.FormatInt(order.OrderId, 10) == orderId {
+      return order
+    }
+  }
+  return nil
+}
+
+// Stores |order| as a new working order and returns its location.
+// Must be called with the mutex held.
+func (f *fakeBroker) addOrder(accountId string, order *tdaOrder) string {
+  order.OrderId = f.nextOrderId
+  f.nextOrderId++
+  order.Status = kOrderWorking
+  order.FilledQuantity = 0
+  order.EnteredTime = time.Now().UTC().Format("2006-01-02T15:04:05+0000")
+  f.maybeFillOrder(order)
+  f.orders[accountId] = append(f.orders[accountId], order)
+  return fmt.Sprintf("%s/v1/accounts/%s/orders/%d", kFakeBrokerPath, accountId, order.OrderId)
+}
+
+func readFakeOrder(w http.ResponseWriter, req *http.Request) *tdaOrder {
+  body, err := ioutil.ReadAll(req.Body)
+  if err != nil {
+    http.Error(w, "Couldn't read body", http.StatusBadRequest)
+    return nil
+  }
+  order := new(tdaOrder)
+  if err := json.Unmarshal(body, order); err != nil || len(order.OrderLegCollection) != 1 {
+    http.Error(w, "Invalid order", http.StatusBadRequest)
+    return nil
+  }
+  return order
+}
+
+// Handles /accounts/<accountId>/orders[/<orderId>].
+//
+// Orders are filled when they are entered at a price crossing the Mark.
+// Otherwise they stay WORKING until they are cancelled or replaced.
+func (f *fakeBroker) ordersHandler(w http.ResponseWriter, req *http.Request, accountId, orderId string) {
+  f.mutex.Lock()
+  defer f.mutex.Unlock()
+
+  if orderId == "" {
+    switch req.Method {
+    case http.MethodGet:
+      // Most recent first, like the real API.
+      orders := make([]*tdaOrder, 0, len(f.orders[accountId]))
+      for i := len(f.orders[accountId]) - 1; i >= 0; i-- {
+        orders = append(orders, f.orders[accountId][i])
+      }
+      writeJSON(w, orders)
+    case http.MethodPost:
+      order := readFakeOrder(w, req)
+      if order == nil {
+        return
+      }
+      w.Header().Set("Location", f.addOrder(accountId, order))
+      w.WriteHeader(http.StatusCreated)
+    default:
+      http.Error(w, "Unsupported", http.StatusMethodNotAllowed)
+    }
+    return
+  }
+
+  existing := f.findOrder(accountId, orderId)
+  if existing == nil {
+    http.NotFound(w, req)
+    return
+  }
+
+  switch req.Method {
+  case http.MethodGet:
+    writeJSON(w, existing)
+  case http.MethodDelete:
+    if existing.Status != kOrderWorking {
+      http.Error(w, "Order can't be cancelled", http.StatusBadRequest)
+      return
+    }
+    existing.Status = kOrderCanceled
+    w.WriteHeader(http.StatusOK)
+  case http.MethodPut:
+    if existing.Status != kOrderWorking {
+      http.Error(w, "Order can't be replaced", http.StatusBadRequest)
+      return
+    }
+    order := readFakeOrder(w, req)
+    if order == nil {
+      return
+    }
+    existing.Status = kOrderReplaced
+    w.Header().Set("Location", f.addOrder(accountId, order))
+    w.WriteHeader(http.StatusCreated)
+  default:
+    http.Error(w, "Unsupported", http.StatusMethodNotAllowed)
+  }
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+  "encoding/json"
+  "fmt"
+  "io/ioutil"
+  "log"
+  "math"
+  "net/http"
+  "net/url"
+  "strconv"
+)
+
+// The filters applied to the options before ranking them.
+//
+// For the maximums, 0 means no limit.
+type OptionFilters struct {
+  MinOpenInterest int `json:"minOpenInterest"`
+  MinVolume int `json:"minVolume"`
+  // The spread between the bid and ask, as a percentage of the mark.
+  MaxSpreadPercent float64 `json:"maxSpreadPercent"`
+  // The delta bounds are on the absolute value, e.g. 0.3 for a -0.3 put.
+  MinDelta float64 `json:"minDelta"`
+  MaxDelta float64 `json:"maxDelta"`
+  // The minimum mark.
+  MinPremium float64 `json:"minPremium"`
+  // How far out-of-the-money the strike is, as a percentage of the spot.
+  // A negative minimum allows in-the-money strikes.
+  MinOutOfTheMoneyPercent float64 `json:"minOutOfTheMoneyPercent"`
+  MaxOutOfTheMoneyPercent float64 `json:"maxOutOfTheMoneyPercent"`
+}
+
+func defaultOptionFilters() *OptionFilters {
+  return &OptionFilters{
+    MinOpenInterest: 10,
+    // Only out-of-the-money strikes.
+    MinOutOfTheMoneyPercent: 0,
+  }
+}
+
+// Returns how far out-of-the-money |option| is, as a percentage of the spot.
+// This is negative for in-the-money options.
+func outOfTheMoneyPercent(option Option) float64 {
+  otm := (option.UnderlyingPrice - option.StrikePrice) / option.UnderlyingPrice * 100
+  if option.PutCall == CALL {
+    return -otm
+  }
+  return otm
+}
+
+// Returns why |option| is filtered out, "" if it passes the filters.
+func (f *OptionFilters) rejectionReason(option Option) string {
+  // Missing quote: the out-of-the-money percentage would be NaN and pass all
+  // the filters.
+  if option.UnderlyingPrice <= 0 {
+    return "No price for the underlying"
+  }
+
+  if option.OpenInterest < f.MinOpenInterest {
+    return fmt.Sprintf("Open interest %d is below %d", option.OpenInterest, f.MinOpenInterest)
+  }
+
+  if option.Volume < f.MinVolume {
+    return fmt.Sprintf("Volume %d is below %d", option.Volume, f.MinVolume)
+  }
+
+  if f.MaxSpreadPercent > 0 {
+    if option.Mark <= 0 {
+      return "No mark to compute the spread"
+    }
+    spread := (option.Ask - option.Bid) / option.Mark * 100
+    if spread > f.MaxSpreadPercent {
+      return fmt.Sprintf("Spread %.1f%% is above %.1f%%", spread, f.MaxSpreadPercent)
+    }
+  }
+
+  if option.MissingGreeks && (f.MinDelta > 0 || f.MaxDelta > 0) {
+    return "No implied volatility to check the delta"
+  }
+  delta := math.Abs(option.Delta)
+  if delta < f.MinDelta {
+    return fmt.Sprintf("Delta %.3f is below %.3f", delta, f.MinDelta)
+  }
+  if f.MaxDelta > 0 && delta > f.MaxDelta {
+    return fmt.Sprintf("Delta %.3f is above %.3f", delta, f.MaxDelta)
+  }
+
+  if option.Mark < f.MinPremium {
+    return fmt.Sprintf("Premium %.2f is below %.2f", option.Mark, f.MinPremium)
+  }
+
+  otm := outOfTheMoneyPercent(option)
+  if otm < f.MinOutOfTheMoneyPercent {
+    return fmt.Sprintf("%.1f%% out-of-the-money is below %.1f%%", otm, f.MinOutOfTheMoneyPercent)
+  }
+  if f.MaxOutOfTheMoneyPercent > 0 && otm > f.MaxOutOfTheMoneyPercent {
+    return fmt.Sprintf("%.1f%% out-of-the-money is above %.1f%%", otm, f.MaxOutOfTheMoneyPercent)
+  }
+
+  return ""
+}
+
+func (f *OptionFilters) validate() error {
+  if f.MaxDelta > 0 && f.MinDelta > f.MaxDelta {
+    return fmt.Errorf("minDelta is above maxDelta")
+  }
+  if f.MaxOutOfTheMoneyPercent > 0 && f.MinOutOfTheMoneyPercent > f.MaxOutOfTheMoneyPercent {
+    return fmt.Errorf("minOutOfTheMoneyPercent is above maxOutOfTheMoneyPercent")
+  }
+  return nil
+}
+
+// Overrides the filters with the ones in |query|.
+func (f *OptionFilters) applyQuery(query url.Values) error {
+  intParams := map[string]*int{
+    "min_open_interest": &f.MinOpenInterest,
+    "min_volume": &f.MinVolume,
+  }
+  for name, field := range intParams {
+    if param := query.Get(name); param != "" {
+      value, err := strconv.Atoi(param)
+      if err != nil {
+        return fmt.Errorf("Invalid %s: %s", name, param)
+      }
+      *field = value
+    }
+  }
+
+  floatParams := map[string]*float64{
+    "max_spread_percent": &f.MaxSpreadPercent,
+    "min_delta": &f.MinDelta,
+    "max_delta": &f.MaxDelta,
+    "min_premium": &f.MinPremium,
+    "min_otm_percent": &f.MinOutOfTheMoneyPercent,
+    "max_otm_percent": &f.MaxOutOfTheMoneyPercent,
+  }
+  for name, field := range floatParams {
+    if param := query.Get(name); param != "" {
+      value, err := strconv.ParseFloat(param, 64)
+      if err != nil {
+        return fmt.Errorf("Invalid %s: %s", name, param)
+      }
+      *field = value
+    }
+  }
+
+  return f.validate()
+}
+
+// Returns the filters for |req|: the user's |preferences| overridden by the
+// query parameters.
+func getRequestFilters(req *http.Request, preferences *Preferences) (*OptionFilters, error) {
+  filters := preferences.optionFilters()
+  if err := filters.applyQuery(req.URL.Query()); err != nil {
+    return nil, err
+  }
+  return filters, nil
+}
+
+// GET returns the filters of the logged in user, PUT replaces them.
+// They are part of the user's preferences.
+func filtersHandler(w http.ResponseWriter, req *http.Request) {
+  logRequest(req)
+
+  session, err := getLoginSession(req)
+  if err != nil {
+    http.Error(w, "Login required", http.StatusUnauthorized)
+    return
+  }
+
+  switch req.Method {
+  case http.MethodGet:
+    preferences, err := getUserPreferences(session.userId())
+    if err != nil {
+      log.Printf("[ERROR] Failed to get the filters (err = %+v)", err)
+      http.Error(w, "Internal Error", http.StatusInternalServerError)
+      return
+    }
+    writeJSON(w, preferences.optionFilters())
+  case http.MethodPut:
+    body, err := ioutil.ReadAll(req.Body)
+    if err != nil {
+      http.Error(w, "Couldn't read body", http.StatusBadRequest)
+      return
+    }
+
+    filters := defaultOptionFilters()
+    if err := json.Unmarshal(body, filters); err != nil {
+      http.Error(w, "Invalid filters", http.StatusBadRequest)
+      return
+    }
+    if err := filters.validate(); err != nil {
+      http.Error(w, err.Error(), http.StatusBadRequest)
+      return
+    }
+
+    _, err = updateUserPreferences(session.userId(), func(preferences *Preferences) {
+      preferences.Filters = filters
+    })
+    if err != nil {
+      log.Printf("[ERROR] Failed to save the filters (err = %+v)", err)
+      http.Error(w, "Internal Error", http.StatusInternalServerError)
+      return
+    }
+    writeJSON(w, filters)
+  default:
+    http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+  }
+}
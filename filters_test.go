@@ -0,0 +1,25 @@
+package main
+
+import (
+  "testing"
+)
+
+func TestRejectionReasonMissingUnderlyingPrice(t *testing.T) {
+  option := Option{
+    PutCall: PUT,
+    StrikePrice: 31,
+    Mark: 0.4,
+    OpenInterest: 100,
+    Delta: -0.2,
+  }
+  filters := defaultOptionFilters()
+  filters.MaxOutOfTheMoneyPercent = 20
+  if reason := filters.rejectionReason(option); reason == "" {
+    t.Errorf("Option without an underlying price passed the out-of-the-money filters")
+  }
+
+  option.UnderlyingPrice = 33.2
+  if reason := filters.rejectionReason(option); reason != "" {
+    t.Errorf("Rejected with an underlying price: %s", reason)
+  }
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+  "math"
+
+  "github.com/jchaffraix/WheelStrategy/pricing"
+)
+
+// Returns true if the broker didn't give us |value|.
+// Brokers use NaN or -999 for missing values.
+func isMissingValue(value float64) bool {
+  return math.IsNaN(value) || value == -999
+}
+
+func pricingContract(option *Option, rate float64) pricing.Contract {
+  right := pricing.Put
+  if option.PutCall == CALL {
+    right = pricing.Call
+  }
+
+  return pricing.Contract{
+    Right: right,
+    // Equity options can be exercised early.
+    Style: pricing.American,
+    Spot: option.UnderlyingPrice,
+    Strike: option.StrikePrice,
+    // Avoid a 0 time to expiration on the expiration day.
+    Years: math.Max(float64(option.DaysToExpiration), 1) / 365,
+    Rate: rate,
+  }
+}
+
+// Prices |option| with our own model, using its Mark and UnderlyingPrice.
+//
+// This fills the greeks and implied volatility that the broker didn't return
+// (the ones we can't compute are set to 0), and sets ModelPrice and
+// AssignmentProbability.
+func priceOption(option *Option, rate float64) {
+  contract := pricingContract(option, rate)
+
+  if isMissingValue(option.ImpliedVolatility) && option.Mark > 0 {
+    if volatility, err := pricing.ImpliedVolatility(contract, option.Mark); err == nil {
+      option.ImpliedVolatility = volatility
+    }
+  }
+
+  var model *pricing.Result
+  if !isMissingValue(option.ImpliedVolatility) {
+    if result, err := pricing.Price(contract, option.ImpliedVolatility); err == nil {
+      model = &result
+      option.ModelPrice = result.Price
+      option.AssignmentProbability, _ = pricing.ProbabilityITM(contract, option.ImpliedVolatility)
+    }
+  }
+
+  fill := func(value *float64, modelValue func(*pricing.Result) float64) {
+    if !isMissingValue(*value) {
+      return
+    }
+    option.GreeksComputed = true
+    if model == nil {
+      *value = 0
+      return
+    }
+    *value = modelValue(model)
+  }
+  fill(&option.Delta, func(r *pricing.Result) float64 { return r.Delta })
+  fill(&option.Gamma, func(r *pricing.Result) float64 { return r.Gamma })
+  fill(&option.Theta, func(r *pricing.Result) float64 { return r.Theta })
+  fill(&option.Vega, func(r *pricing.Result) float64 { return r.Vega })
+  fill(&option.TheoreticalValue, func(r *pricing.Result) float64 { return r.Price })
+
+  if isMissingValue(option.ImpliedVolatility) {
+    option.ImpliedVolatility = 0
+    option.MissingGreeks = true
+  }
+}
@@ -3,13 +3,14 @@ package main
 import (
   "context"
   "encoding/json"
-  "encoding/base64"
-  "fmt"
-  "io/ioutil"
+  "errors"
+  "flag"
   "log"
   "net/http"
   "net/url"
   "os"
+  "strings"
+  "sync"
   "time"
 
   "golang.org/x/oauth2"
@@ -18,9 +19,85 @@ import (
 )
 
 type AppSettings struct {
+  // Which broker to use, see newBroker.
+  // Defaults to TDAmeritrade if empty.
+  Broker string `json:"broker" datastore:",noindex"`
+
   // OAuth parameters as displayed in TDAmeritrade.
-  TDAClientId string `json:"tda_client_id", datastore:",noindex"`
-  TDARedirectURL string `json:"tda_redirect_url", datastore:",noindex"`
+  TDAClientId string `json:"tda_client_id" datastore:",noindex"`
+  TDARedirectURL string `json:"tda_redirect_url" datastore:",noindex"`
+
+  // OAuth parameters as displayed in the Schwab developer portal.
+  SchwabClientId string `json:"schwab_client_id" datastore:",noindex"`
+  SchwabClientSecret string `json:"schwab_client_secret" datastore:",noindex"`
+  SchwabRedirectURL string `json:"schwab_redirect_url" datastore:",noindex"`
+
+  // Overrides for the broker's endpoints, mostly useful to point to a local
+  // stand-in when testing. The broker's defaults are used if empty.
+  // APIBaseURL is the prefix for all market-data and account calls.
+  APIBaseURL string `json:"api_base_url" datastore:",noindex"`
+  AuthURL string `json:"auth_url" datastore:",noindex"`
+  TokenURL string `json:"token_url" datastore:",noindex"`
+
+  // The risk-free rate used to compute the greeks the broker doesn't return,
+  // e.g. 0.04 for 4%. Defaults to kDefaultRiskFreeRate if 0.
+  RiskFreeRate float64 `json:"risk_free_rate" datastore:",noindex"`
+
+  // The expected annual return of the underlyings, e.g. 0.08 for 8%.
+  // This is the real-world drift used for the expected value of the
+  // suggestions. Defaults to kDefaultExpectedReturn if 0.
+  ExpectedReturn float64 `json:"expected_return" datastore:",noindex"`
+
+  // The key used to sign the LOGIN cookie. It must be kept secret.
+  // Required, except with the fake broker, see getSessionKey.
+  SessionKey string `json:"session_key" datastore:",noindex"`
+
+  // Whether to send a PKCE challenge when logging in, see oauth_state.go.
+  UsePKCE bool `json:"use_pkce" datastore:",noindex"`
+}
+
+// Replaces a secret in the logs.
+const kRedacted string = "[REDACTED]"
+
+func redact(secret string) string {
+  if secret == "" {
+    return ""
+  }
+  return kRedacted
+}
+
+// Returns a copy of the settings that can be logged.
+func (s AppSettings) redacted() AppSettings {
+  s.SchwabClientSecret = redact(s.SchwabClientSecret)
+  s.SessionKey = redact(s.SessionKey)
+  return s
+}
+
+const kDefaultRiskFreeRate float64 = 0.04
+
+// The long run return of US equities.
+const kDefaultExpectedReturn float64 = 0.08
+
+func (s *AppSettings) riskFreeRate() float64 {
+  if s.RiskFreeRate == 0 {
+    return kDefaultRiskFreeRate
+  }
+  return s.RiskFreeRate
+}
+
+func (s *AppSettings) expectedReturn() float64 {
+  if s.ExpectedReturn == 0 {
+    return kDefaultExpectedReturn
+  }
+  return s.ExpectedReturn
+}
+
+// Returns |override| if set, |defaultValue| otherwise.
+func settingOrDefault(override, defaultValue string) string {
+  if override != "" {
+    return override
+  }
+  return defaultValue
 }
 
 const kAppSettingsTable string = "Settings"
@@ -38,10 +115,35 @@ func getLocalAppSettings() *AppSettings {
     return nil
   }
 
-  log.Printf("Using local settings: %+v", *settings)
+  log.Printf("Using local settings: %+v", settings.redacted())
   return settings
 }
 
+// The client shared by all the requests, created in main.
+// It is nil with the fake broker as everything is then kept in memory.
+var datastoreClient *datastore.Client
+
+func newDatastoreClient(ctx context.Context) (*datastore.Client, error) {
+  return datastore.NewClient(ctx, os.Getenv("PROJECT_ID"))
+}
+
+func getDatastoreClient() (*datastore.Client, error) {
+  if datastoreClient == nil {
+    return nil, errors.New("No Datastore client")
+  }
+  return datastoreClient, nil
+}
+
+// Every request needs the settings so we only read them from Datastore
+// every kAppSettingsCacheDuration.
+const kAppSettingsCacheDuration = 5 * time.Minute
+
+var (
+  appSettingsMutex sync.Mutex
+  cachedAppSettings *AppSettings
+  cachedAppSettingsTime time.Time
+)
+
 func getAppSettings() (*AppSettings, error) {
   // Useful for local testing.
   local_settings := getLocalAppSettings()
@@ -49,18 +151,29 @@ func getAppSettings() (*AppSettings, error) {
     return local_settings, nil
   }
 
-  ctx := context.Background()
-  client, err := datastore.NewClient(ctx, os.Getenv("PROJECT_ID"))
+  if fakeBrokerSettings != nil {
+    return fakeBrokerSettings, nil
+  }
+
+  appSettingsMutex.Lock()
+  defer appSettingsMutex.Unlock()
+  if cachedAppSettings != nil && time.Since(cachedAppSettingsTime) < kAppSettingsCacheDuration {
+    return cachedAppSettings, nil
+  }
+
+  client, err := getDatastoreClient()
   if err != nil {
     return nil, err
   }
 
   settings := new(AppSettings)
   k := datastore.NameKey(kAppSettingsTable, "app_settings", nil)
-  if err := client.Get(ctx, k, settings); err != nil {
+  if err := client.Get(context.Background(), k, settings); err != nil {
     return nil, err
   }
 
+  cachedAppSettings = settings
+  cachedAppSettingsTime = time.Now()
   return settings, nil
 }
 
@@ -70,65 +183,34 @@ func getOAuthClient() (*oauth2.Config, error) {
     return nil, err
   }
 
-  return &oauth2.Config{
-		ClientID: fmt.Sprintf("%s@AMER.OAUTHAP", s.TDAClientId),
-    // TDAmetridate doesn't have a secret....
-		ClientSecret: "",
-		Scopes: []string{},
-		Endpoint: oauth2.Endpoint{
-			TokenURL: "https://api.tdameritrade.com/v1/oauth2/token",
-			AuthURL:  "https://auth.tdameritrade.com/auth",
-		},
-    RedirectURL: s.TDARedirectURL,
-	}, nil
+  return newOAuthConfig(s), nil
 }
 
-func getLoginCookieData(req *http.Request) (*CookieData, error) {
-  loginCookie, err := req.Cookie(kLoginCookieName)
-  if err != nil {
-    // TODO: ErrNoCookie is emitted when not present.
-    log.Printf("[INFO] Couldn't get login cookie (err = %+v)", err)
-    return nil, err
-  }
-
-  cookie_value, err := base64.StdEncoding.DecodeString(loginCookie.Value)
-  if err != nil {
-    log.Printf("[Error] Base64 decode the login cookie (err = %+v)", err)
-    return nil, err
+// The queries of the OAuth requests aren't logged as they have the
+// authorization code and the state.
+func logRequest(req *http.Request) {
+  if strings.HasPrefix(req.URL.Path, "/oauth/") {
+    log.Printf("Received request for %s", req.URL.Path)
+    return
   }
+  log.Printf("Received request for %s", req.URL.String())
+}
 
-  loginInfo := new(CookieData)
-  err = json.Unmarshal(cookie_value, &loginInfo)
+func writeJSON(w http.ResponseWriter, resp any) {
+  bytes, err := json.Marshal(resp)
   if err != nil {
-    log.Printf("[ERROR] Cookie is invalid, failed to parse it (err = %+v)", err)
-    // TODO: Clear the cookie to help recoveries?
-    return nil, err
+    log.Printf("[ERROR] Failed to marshal the response (err = %+v)", err)
+    http.Error(w, "Internal Error", http.StatusInternalServerError)
+    return
   }
 
-  return loginInfo, nil
-}
-
-func logRequest(req *http.Request) {
-  log.Printf("Received request for %s", req.URL.String())
+  w.Header().Add("Content-Type", "application/json")
+  w.Write(bytes)
 }
 
 const kLoginCookieName string = "LOGIN"
 
-type CookieData struct {
-  TDAAccountId string `json:"tda_account_id"`
-  TDAAccessToken string `json:"tda_access_token"`
-  // TODO: Add expiry + refresh_token.
-}
-
-type SecuritiesAccount struct {
-  AccountId string `json:"accountId"`
-}
-
-type Account struct {
-  SecuritiesAccount SecuritiesAccount `json:"securitiesAccount"`
-  // Ignore all other fields
-}
-
+// The LOGIN cookie holds the signed session ID, see session.go.
 func oauthRedirectHandler(w http.ResponseWriter, req *http.Request) {
   logRequest(req)
 
@@ -149,7 +231,17 @@ func oauthRedirectHandler(w http.ResponseWriter, req *http.Request) {
     log.Printf("[WARN] More than one code returned... Using the first one")
   }
 
-  // TODO: Validate the state!
+  state, err := checkOAuthState(w, req, query.Get("state"))
+  if errors.Is(err, errInvalidOAuthState) {
+    log.Printf("[WARN] Rejected the OAuth redirect (err = %+v)", err)
+    http.Error(w, "Invalid state, try logging in again", http.StatusBadRequest)
+    return
+  }
+  if err != nil {
+    log.Printf("[ERROR] Failed checking the OAuth state (err = %+v)", err)
+    http.Error(w, "Internal Error", http.StatusInternalServerError)
+    return
+  }
 
   conf, err := getOAuthClient()
   if err != nil {
@@ -159,87 +251,89 @@ func oauthRedirectHandler(w http.ResponseWriter, req *http.Request) {
   }
 
   ctx := context.Background()
-  // TODO: I need to be in the offline mode to get a refresh token from the OAuth exchange.
-  token, err := conf.Exchange(ctx, codes[0])
+  token, err := conf.Exchange(ctx, codes[0], state.exchangeOptions()...)
 	if err != nil {
     log.Printf("[ERROR] Failed exchanging code (err = %+v)", err)
     http.Error(w, "Internal Error", http.StatusInternalServerError)
     return
   }
 
-  log.Printf("AccessToken: %s", token.AccessToken)
-  log.Printf("Expiry: %+v", token.Expiry)
-  log.Printf("Refresh Token: %s", token.RefreshToken)
+  log.Printf("[INFO] Got a token expiring at %v (has refresh token = %t)", token.Expiry, token.RefreshToken != "")
 
   // Get account ID.
-  client := conf.Client(ctx, token)
-  resp, err := client.Get("https://api.tdameritrade.com/v1/accounts")
-	if err != nil {
-    log.Printf("[ERROR] Failed getting the accounts for the user (err = %+v)", err)
-    http.Error(w, "Internal Error", http.StatusInternalServerError)
-    return
-  }
-  defer resp.Body.Close()
-  body, err := ioutil.ReadAll(resp.Body)
+  settings, err := getAppSettings()
   if err != nil {
-    log.Printf("[ERROR] Failed to read response (err = %+v)", err)
+    log.Printf("[ERROR] Failed getting the app settings (err = %+v)", err)
     http.Error(w, "Internal Error", http.StatusInternalServerError)
     return
   }
-
-  var accounts []Account
-  err = json.Unmarshal(body, &accounts)
+  broker := newBroker(settings, conf.Client(ctx, token))
+  accountIds, err := broker.GetAccountIds()
   if err != nil {
-    log.Printf("[ERROR] Failed to parse the accounts response (err = %+v): %+v", err, string(body))
+    log.Printf("[ERROR] Failed getting the accounts for the user (err = %+v)", err)
     http.Error(w, "Internal Error", http.StatusInternalServerError)
     return
   }
-  if len(accounts) > 1 {
-    log.Printf("[ERROR] Ignoring multiple accounts and picking first one")
+  if len(accountIds) == 0 {
+    log.Printf("[ERROR] No account returned for the user")
     http.Error(w, "Internal Error", http.StatusInternalServerError)
+    return
   }
 
-  // Store in a cookie (DB-less for now).
-  cookie, err := json.Marshal(CookieData{
-    TDAAccountId: accounts[0].SecuritiesAccount.AccountId,
-    TDAAccessToken: token.AccessToken,
-  })
+  // The accounts the login gives access to identify the user, the first one
+  // is selected until the user picks another one.
+  userId, err := recordUserLogin(accountIds)
   if err != nil {
-    log.Printf("[ERROR] Failed to marshal the cookie (err = %+v)", err)
+    log.Printf("[ERROR] Failed to record the user's login (err = %+v)", err)
     http.Error(w, "Internal Error", http.StatusInternalServerError)
     return
   }
 
-  // TODO: Make this a constant.
-  expiry, _ := time.ParseDuration("30m")
-  http.SetCookie(w, &http.Cookie{
-    Name: kLoginCookieName,
-    Value: base64.StdEncoding.EncodeToString(cookie),
-    Path: "/",
-    Expires: time.Now().Add(expiry),
-  })
+  session := &Session{
+    AccountId: accountIds[0],
+    AccountIds: accountIds,
+    UserId: userId,
+    Token: *token,
+    CreatedAt: time.Now(),
+  }
+  if err := startSession(w, req, session); err != nil {
+    log.Printf("[ERROR] Failed to start the session (err = %+v)", err)
+    http.Error(w, "Internal Error", http.StatusInternalServerError)
+    return
+  }
   http.Redirect(w, req, "/", 302)
 }
 
 func oauthLoginHandler(w http.ResponseWriter, req *http.Request) {
-  conf, err := getOAuthClient()
+  settings, err := getAppSettings()
   if err != nil {
-    log.Printf("Error when getting the oauth client (err = %+v)", err)
+    log.Printf("Error when getting the app settings (err = %+v)", err)
     http.Error(w, "Internal Error", http.StatusInternalServerError)
     return
   }
+  conf := newOAuthConfig(settings)
 
-  // TODO: Fill state for real so we can validate the redirect.
-  state := "state"
-  url := conf.AuthCodeURL(state, oauth2.AccessTypeOffline)
+  state, err := newOAuthState(settings.UsePKCE)
+  if err != nil {
+    log.Printf("[ERROR] Failed generating the OAuth state (err = %+v)", err)
+    http.Error(w, "Internal Error", http.StatusInternalServerError)
+    return
+  }
+  if err := setOAuthStateCookie(w, req, state); err != nil {
+    log.Printf("[ERROR] Failed setting the OAuth state cookie (err = %+v)", err)
+    http.Error(w, "Internal Error", http.StatusInternalServerError)
+    return
+  }
+  url := conf.AuthCodeURL(state.State, state.authCodeOptions()...)
 
   http.Redirect(w, req, url, 302)
 }
 
+// The tokens stay on the server, only the login state is returned.
 type oauthInfoResponse struct {
   LoggedIn bool `json:"logged_in"`
-  TDAAccountId string `json:"tda_account_id"`
-  TDAAccessToken string `json:"tda_access_token"`
+  // The selected account.
+  AccountId string `json:"account_id"`
 }
 
 func oauthInfoHandler(w http.ResponseWriter, req *http.Request) {
@@ -263,17 +357,15 @@ func oauthInfoHandler(w http.ResponseWriter, req *http.Request) {
     w.Write(respStr)
   }()
 
-  loginData, err := getLoginCookieData(req)
+  session, err := getLoginSession(req)
   if err != nil {
-    // Ignore error as we log in getLoginCookieData.
+    // Ignore error as we log in getLoginSession.
     return
   }
 
-  log.Printf("[INFO] Found AccountID %s", loginData.TDAAccountId)
-  log.Printf("[INFO] Found Access-Token %s", loginData.TDAAccessToken)
+  log.Printf("[INFO] Found AccountID %s", session.AccountId)
   resp.LoggedIn = true
-  resp.TDAAccountId = loginData.TDAAccountId
-  resp.TDAAccessToken = loginData.TDAAccessToken
+  resp.AccountId = session.AccountId
 }
 
 func mainPageHandler(w http.ResponseWriter, req *http.Request) {
@@ -287,10 +379,16 @@ func mainPageHandler(w http.ResponseWriter, req *http.Request) {
   http.ServeFile(w, req, "index.html")
 }
 
+// Symbol used when /options is called without one and the user has no
+// default symbols, see Preferences.
+const kDefaultSymbol string = "WY"
+
 type optionsHandlerResponse struct {
   Quote Quote `json:"quote"`
   Options []Option `json:"options"`
   Suggestions []Option `json:"suggestions"`
+  // The cash usable as collateral, null if not logged in.
+  CashAvailable *float64 `json:"cashAvailable"`
 }
 
 func optionsHandler(w http.ResponseWriter, req *http.Request) {
@@ -301,34 +399,64 @@ func optionsHandler(w http.ResponseWriter, req *http.Request) {
     return
   }
 
-  // TODO: Allow the symbol to be customized.
-  symbol := "WY"
+  session, accountId, ok := getOptionalRequestAccount(w, req)
+  if !ok {
+    return
+  }
+  broker := getBroker(settings, session)
+  preferences := getSessionPreferences(session)
 
-  // Get the symbol for its last price (used to filter the options).
-  quote, err := GetQuote(symbol, settings.TDAClientId)
+  params, err := getSuggestionParams(req, preferences)
   if err != nil {
-    log.Printf("[ERROR] Failed to get quote for symbol %s (err = %+v)", symbol, err)
-    http.Error(w, "Internal Error", http.StatusInternalServerError)
+    http.Error(w, err.Error(), http.StatusBadRequest)
+    return
+  }
+  chainParams, err := getRequestChainParams(req, preferences)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusBadRequest)
     return
   }
 
-  start := time.Now().AddDate(/*years*/0, /*months*/0, /*days*/20)
-  end := start.AddDate(/*years*/0, /*months*/0, /*days*/30)
-  options, err := GetOptionChain(symbol, settings.TDAClientId, PUT, start, end)
+  symbol := preferences.defaultSymbol()
+  if symbolParam := req.URL.Query().Get("symbol"); symbolParam != "" {
+    var valid bool
+    symbol, valid = normalizeSymbol(symbolParam)
+    if !valid {
+      http.Error(w, "Invalid symbol", http.StatusBadRequest)
+      return
+    }
+  }
+
+  quote, options, err := getSymbolOptions(broker, symbol, PUT, chainParams, settings.riskFreeRate())
+  if errors.Is(err, errNotLoggedIn) {
+    http.Error(w, "Login required", http.StatusUnauthorized)
+    return
+  }
+  if errors.Is(err, errUnknownSymbol) {
+    http.Error(w, "Unknown symbol " + symbol, http.StatusBadRequest)
+    return
+  }
   if err != nil {
-    log.Printf("[ERROR] Failed to get option chains for symbol %s (err = %+v)", symbol, err)
+    log.Printf("[ERROR] Failed to get options for symbol %s (err = %+v)", symbol, err)
     http.Error(w, "Internal Error", http.StatusInternalServerError)
     return
   }
 
+  if err := params.setBalanceFromAccount(broker, accountId); err != nil {
+    writeBrokerError(w, err, "get the account balance")
+    return
+  }
+
   // Filter those options.
-  suggestions := FilterOptions(1<<64 - 1.24, quote.LastPrice, options)
+  suggestions := FilterOptions(options, params)
+  setRiskMetrics(suggestions, settings.riskFreeRate(), settings.expectedReturn())
 
   w.Header().Add("Content-Type", "application/json")
   resp := optionsHandlerResponse{
     Quote: *quote,
     Options: options,
     Suggestions: suggestions,
+    CashAvailable: params.balanceForResponse(),
   }
   bytes, err := json.Marshal(resp)
   if err != nil {
@@ -343,36 +471,61 @@ func optionsHandler(w http.ResponseWriter, req *http.Request) {
 type userInfo struct {
   AccountId string `json:"account_id"`
   CashAvailableForTrading float64 `json:"cash_available"`
+  Positions []Position `json:"positions"`
 }
 
 type userInfoResponse struct {
+  LoggedIn bool `json:"logged_in"`
+  // The account targeted by the request, see accounts.go.
   UserInfo *userInfo `json:"user_info"`
-  AccessToken *string `json:"access_token"`
+  // All the linked accounts, including the one above.
+  Accounts []userInfo `json:"accounts"`
 }
 
 func userInfoHandler(w http.ResponseWriter, req *http.Request) {
   w.Header().Add("Content-Type", "application/json")
   resp := userInfoResponse{
+    Accounts: []userInfo{},
   }
 
-  // Get the cookie information if we have one.
-  // We ignore err as it is logged by getLoginCookieData.
-  cookieData, _ := getLoginCookieData(req)
-  if cookieData != nil {
-    userAccountInfo, err := GetUserAccountInfo(cookieData.TDAAccountId, cookieData.TDAAccessToken)
+  // Get the session if we have one.
+  // We ignore err as it is logged by getLoginSession.
+  session, _ := getLoginSession(req)
+  if session != nil {
+    accountId, err := session.requestAccountId(req)
+    if err != nil {
+      http.Error(w, "Unknown account", http.StatusBadRequest)
+      return
+    }
+
+    settings, err := getAppSettings()
     if err != nil {
-      log.Printf("[ERROR] Failed to get user account info (err = %+v)", err)
+      log.Printf("[ERROR] Failed getting the app settings (err = %+v)", err)
       http.Error(w, "Internal Error", http.StatusInternalServerError)
       return
     }
-    log.Printf("[INFO] Found AccountID %s", cookieData.TDAAccountId)
-    log.Printf("[INFO] Found Access-Token %s", cookieData.TDAAccessToken)
 
-    resp.UserInfo = &userInfo{
-      AccountId: cookieData.TDAAccountId,
-      CashAvailableForTrading: userAccountInfo.CashAvailableForTrading,
+    broker := getBroker(settings, session)
+    for _, linkedId := range session.linkedAccountIds() {
+      userAccountInfo, err := broker.GetUserAccountInfo(linkedId)
+      if err != nil {
+        writeBrokerError(w, err, "get user account info")
+        return
+      }
+
+      info := userInfo{
+        AccountId: linkedId,
+        CashAvailableForTrading: userAccountInfo.CashAvailableForTrading,
+        Positions: userAccountInfo.Positions,
+      }
+      resp.Accounts = append(resp.Accounts, info)
+      if linkedId == accountId {
+        resp.UserInfo = &info
+      }
     }
-    resp.AccessToken = &cookieData.TDAAccessToken
+    log.Printf("[INFO] Found AccountID %s", accountId)
+
+    resp.LoggedIn = true
   }
 
   bytes, err := json.Marshal(resp)
@@ -386,12 +539,30 @@ func userInfoHandler(w http.ResponseWriter, req *http.Request) {
 }
 
 func main() {
+  fakeBroker := flag.Bool("fake-broker", false, "Serve a fake broker from fixtures and use it instead of the real one")
+  fakeBrokerFixtures := flag.String("fake-broker-fixtures", "fake_broker", "Directory containing the fake broker's fixtures")
+  flag.Parse()
+
   http.HandleFunc("/", mainPageHandler)
   http.HandleFunc("/oauth/redirect", oauthRedirectHandler)
   http.HandleFunc("/oauth/login", oauthLoginHandler)
   http.HandleFunc("/oauth/info", oauthInfoHandler)
+  http.HandleFunc("/oauth/logout", logoutHandler)
   http.HandleFunc("/options", optionsHandler)
   http.HandleFunc("/user/info", userInfoHandler)
+  http.HandleFunc("/accounts", accountsHandler)
+  http.HandleFunc("/user/preferences", preferencesHandler)
+  http.HandleFunc("/watchlist", watchlistHandler)
+  http.HandleFunc("/filters", filtersHandler)
+  http.HandleFunc("/chain_params", chainParamsHandler)
+  http.HandleFunc("/scan", scanHandler)
+  http.HandleFunc("/calls", coveredCallsHandler)
+  http.HandleFunc("/cycles", cyclesHandler)
+  http.HandleFunc("/orders", ordersHandler)
+  http.HandleFunc("/orders/", ordersHandler)
+  http.HandleFunc("/rolls", rollsHandler)
+  http.HandleFunc("/walks", walksHandler)
+  http.HandleFunc("/walks/", walksHandler)
   http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
 
   port := os.Getenv("PORT")
@@ -399,6 +570,22 @@ func main() {
     port = "8080"
   }
 
+  if *fakeBroker {
+    log.Printf("Using the fake broker with fixtures from %s", *fakeBrokerFixtures)
+    fakeBrokerSettings = registerFakeBroker(http.DefaultServeMux, *fakeBrokerFixtures, "http://localhost:" + port)
+    // The fake broker is for running offline, without Datastore.
+    sessionStore = newMemorySessionStore()
+    entityStore = newMemoryEntityStore()
+    cycleStore = newMemoryCycleStore()
+  } else {
+    client, err := newDatastoreClient(context.Background())
+    if err != nil {
+      log.Fatalf("Failed to create the Datastore client (err = %+v)", err)
+    }
+    defer client.Close()
+    datastoreClient = client
+  }
+
   log.Printf("Listening on port=%s", port)
   if err := http.ListenAndServe(":" + port, nil); err != nil {
     log.Fatal(err)
@@ -0,0 +1,131 @@
+package main
+
+import (
+  "crypto/hmac"
+  "crypto/sha256"
+  "crypto/subtle"
+  "encoding/base64"
+  "errors"
+  "log"
+  "net/http"
+  "strings"
+  "time"
+
+  "golang.org/x/oauth2"
+)
+
+// Each login gets a random OAuth state, checked when the broker redirects
+// back to us so a third party can't complete a login with its own code (CSRF).
+//
+// The state is kept in the short-lived OAUTH_STATE cookie, signed like the
+// LOGIN cookie. When AppSettings.UsePKCE is set, the cookie also holds the
+// PKCE code verifier (RFC 7636) that is sent when exchanging the code.
+
+const kOAuthStateCookieName string = "OAUTH_STATE"
+
+// How long the user has to complete the login on the broker's side.
+const kOAuthStateDuration = 10 * time.Minute
+
+// Returned by checkOAuthState when the state doesn't match the cookie.
+var errInvalidOAuthState = errors.New("Invalid OAuth state")
+
+type oauthState struct {
+  State string
+  // Empty if PKCE is disabled.
+  CodeVerifier string
+}
+
+func newOAuthState(usePKCE bool) (*oauthState, error) {
+  state, err := newRandomString()
+  if err != nil {
+    return nil, err
+  }
+
+  s := &oauthState{State: state}
+  if usePKCE {
+    s.CodeVerifier, err = newRandomString()
+    if err != nil {
+      return nil, err
+    }
+  }
+  return s, nil
+}
+
+// The options to pass to AuthCodeURL.
+func (s *oauthState) authCodeOptions() []oauth2.AuthCodeOption {
+  options := []oauth2.AuthCodeOption{oauth2.AccessTypeOffline}
+  if s.CodeVerifier != "" {
+    challenge := sha256.Sum256([]byte(s.CodeVerifier))
+    options = append(options,
+      oauth2.SetAuthURLParam("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:])),
+      oauth2.SetAuthURLParam("code_challenge_method", "S256"))
+  }
+  return options
+}
+
+// The options to pass to Exchange.
+func (s *oauthState) exchangeOptions() []oauth2.AuthCodeOption {
+  if s.CodeVerifier == "" {
+    return nil
+  }
+  return []oauth2.AuthCodeOption{oauth2.SetAuthURLParam("code_verifier", s.CodeVerifier)}
+}
+
+// Sets the OAUTH_STATE cookie.
+// The cookie's value is "<state>.<code verifier>.<signature>".
+func setOAuthStateCookie(w http.ResponseWriter, req *http.Request, s *oauthState) error {
+  key, err := getSessionKey()
+  if err != nil {
+    return err
+  }
+
+  value := s.State + "." + s.CodeVerifier
+  http.SetCookie(w, &http.Cookie{
+    Name: kOAuthStateCookieName,
+    Value: value + "." + signValue(key, value),
+    Path: "/oauth/",
+    MaxAge: int(kOAuthStateDuration.Seconds()),
+    HttpOnly: true,
+    Secure: isSecureRequest(req),
+    // Lax so the cookie is sent when the broker redirects back to us.
+    SameSite: http.SameSiteLaxMode,
+  })
+  return nil
+}
+
+// Returns the state from the OAUTH_STATE cookie if it matches |state|.
+// The cookie is cleared as a state is only good for one login.
+func checkOAuthState(w http.ResponseWriter, req *http.Request, state string) (*oauthState, error) {
+  cookie, err := req.Cookie(kOAuthStateCookieName)
+  if err != nil {
+    return nil, errInvalidOAuthState
+  }
+
+  http.SetCookie(w, &http.Cookie{
+    Name: kOAuthStateCookieName,
+    Path: "/oauth/",
+    MaxAge: -1,
+    HttpOnly: true,
+    Secure: isSecureRequest(req),
+    SameSite: http.SameSiteLaxMode,
+  })
+
+  parts := strings.Split(cookie.Value, ".")
+  if len(parts) != 3 {
+    return nil, errInvalidOAuthState
+  }
+
+  key, err := getSessionKey()
+  if err != nil {
+    return nil, err
+  }
+  value := parts[0] + "." + parts[1]
+  if !hmac.Equal([]byte(parts[2]), []byte(signValue(key, value))) {
+    log.Printf("[WARN] The OAuth state cookie has an invalid signature")
+    return nil, errInvalidOAuthState
+  }
+  if state == "" || subtle.ConstantTimeCompare([]byte(state), []byte(parts[0])) != 1 {
+    return nil, errInvalidOAuthState
+  }
+  return &oauthState{State: parts[0], CodeVerifier: parts[1]}, nil
+}
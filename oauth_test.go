@@ -0,0 +1,211 @@
+package main
+
+import (
+  "net/http"
+  "net/http/httptest"
+  "net/url"
+  "strings"
+  "testing"
+)
+
+// Serves the OAuth handlers next to the fake broker.
+func newOAuthTestServer(t *testing.T) *httptest.Server {
+  mux := http.NewServeMux()
+  server := httptest.NewServer(mux)
+  mux.HandleFunc("/oauth/login", oauthLoginHandler)
+  mux.HandleFunc("/oauth/redirect", oauthRedirectHandler)
+
+  oldSettings, oldSessionStore, oldEntityStore, oldSessionKey := fakeBrokerSettings, sessionStore, entityStore, sessionKey
+  fakeBrokerSettings = registerFakeBroker(mux, "fake_broker", server.URL)
+  sessionStore = newMemorySessionStore()
+  entityStore = newMemoryEntityStore()
+  sessionKey = []byte("test-session-key")
+  t.Cleanup(func() {
+    server.Close()
+    fakeBrokerSettings, sessionStore, entityStore, sessionKey = oldSettings, oldSessionStore, oldEntityStore, oldSessionKey
+  })
+  return server
+}
+
+// Doesn't follow the redirects so we can look at each step.
+var noRedirectClient = &http.Client{
+  CheckRedirect: func(req *http.Request, via []*http.Request) error {
+    return http.ErrUseLastResponse
+  },
+}
+
+func findCookie(resp *http.Response, name string) *http.Cookie {
+  for _, cookie := range resp.Cookies() {
+    if cookie.Name == name {
+      return cookie
+    }
+  }
+  return nil
+}
+
+// Starts a login and lets the fake broker grant it.
+// Returns the OAUTH_STATE cookie and the URL the broker redirects to.
+func startFakeLogin(t *testing.T, server *httptest.Server) (*http.Cookie, *url.URL) {
+  resp, err := noRedirectClient.Get(server.URL + "/oauth/login")
+  if err != nil {
+    t.Fatalf("Login failed: %v", err)
+  }
+  resp.Body.Close()
+  if resp.StatusCode != http.StatusFound {
+    t.Fatalf("Login returned %d, want %d", resp.StatusCode, http.StatusFound)
+  }
+  stateCookie := findCookie(resp, kOAuthStateCookieName)
+  if stateCookie == nil {
+    t.Fatalf("Login didn't set the %s cookie", kOAuthStateCookieName)
+  }
+
+  resp, err = noRedirectClient.Get(resp.Header.Get("Location"))
+  if err != nil {
+    t.Fatalf("Authorization failed: %v", err)
+  }
+  resp.Body.Close()
+  redirectURL, err := url.Parse(resp.Header.Get("Location"))
+  if err != nil || redirectURL.Query().Get("code") == "" {
+    t.Fatalf("The broker didn't redirect with a code: %q", resp.Header.Get("Location"))
+  }
+  return stateCookie, redirectURL
+}
+
+// Calls the redirect handler at |redirectURL| with |stateCookie| (if not nil).
+func finishFakeLogin(t *testing.T, stateCookie *http.Cookie, redirectURL *url.URL) *http.Response {
+  req, err := http.NewRequest(http.MethodGet, redirectURL.String(), nil)
+  if err != nil {
+    t.Fatalf("Invalid redirect: %v", err)
+  }
+  if stateCookie != nil {
+    req.AddCookie(&http.Cookie{Name: stateCookie.Name, Value: stateCookie.Value})
+  }
+  resp, err := noRedirectClient.Do(req)
+  if err != nil {
+    t.Fatalf("Redirect failed: %v", err)
+  }
+  resp.Body.Close()
+  return resp
+}
+
+// Returns |stateCookie| with its code verifier replaced by |verifier|, signed
+// with the session key.
+func withCodeVerifier(stateCookie *http.Cookie, verifier string) *http.Cookie {
+  state, _, _ := strings.Cut(stateCookie.Value, ".")
+  value := state + "." + verifier
+  return &http.Cookie{
+    Name: stateCookie.Name,
+    Value: value + "." + signValue(sessionKey, value),
+  }
+}
+
+func TestOAuthLogin(t *testing.T) {
+  server := newOAuthTestServer(t)
+  stateCookie, redirectURL := startFakeLogin(t, server)
+
+  resp := finishFakeLogin(t, stateCookie, redirectURL)
+  if resp.StatusCode != http.StatusFound {
+    t.Fatalf("Redirect returned %d, want %d", resp.StatusCode, http.StatusFound)
+  }
+  loginCookie := findCookie(resp, kLoginCookieName)
+  if loginCookie == nil {
+    t.Fatalf("The redirect didn't set the %s cookie", kLoginCookieName)
+  }
+  if !loginCookie.HttpOnly {
+    t.Errorf("The %s cookie isn't HttpOnly", kLoginCookieName)
+  }
+  stateCookie = findCookie(resp, kOAuthStateCookieName)
+  if stateCookie == nil || stateCookie.MaxAge >= 0 || !stateCookie.HttpOnly || stateCookie.SameSite != http.SameSiteLaxMode {
+    t.Errorf("The %s cookie isn't cleared with the same attributes: %+v", kOAuthStateCookieName, stateCookie)
+  }
+
+  id, err := parseSessionCookieValue(loginCookie.Value)
+  if err != nil {
+    t.Fatalf("Invalid %s cookie: %v", kLoginCookieName, err)
+  }
+  session, err := sessionStore.Get(id)
+  if err != nil {
+    t.Fatalf("No session for the %s cookie: %v", kLoginCookieName, err)
+  }
+  if session.Token.AccessToken != kFakeBrokerAccessToken {
+    t.Errorf("AccessToken = %q, want %q", session.Token.AccessToken, kFakeBrokerAccessToken)
+  }
+  for _, accountId := range session.AccountIds {
+    link := new(UserAccount)
+    if found, err := entityStore.Get(kUserAccountsTable, accountId, link); !found || err != nil || link.UserId != session.UserId {
+      t.Errorf("Account %s isn't linked to the user %q (found = %t, err = %v)", accountId, session.UserId, found, err)
+    }
+  }
+}
+
+func TestOAuthRedirectRejected(t *testing.T) {
+  tests := []struct {
+    name string
+    // Returns the redirect and cookie to send in place of the broker's ones.
+    tamper func(stateCookie *http.Cookie, redirectURL *url.URL) (*http.Cookie, *url.URL)
+    wantStatus int
+  }{
+    {
+      name: "missing state cookie",
+      tamper: func(stateCookie *http.Cookie, redirectURL *url.URL) (*http.Cookie, *url.URL) {
+        return nil, redirectURL
+      },
+      wantStatus: http.StatusBadRequest,
+    },
+    {
+      name: "tampered signature",
+      tamper: func(stateCookie *http.Cookie, redirectURL *url.URL) (*http.Cookie, *url.URL) {
+        tampered := *stateCookie
+        last := "A"
+        if strings.HasSuffix(tampered.Value, last) {
+          last = "B"
+        }
+        tampered.Value = tampered.Value[:len(tampered.Value) - 1] + last
+        return &tampered, redirectURL
+      },
+      wantStatus: http.StatusBadRequest,
+    },
+    {
+      name: "state mismatch",
+      tamper: func(stateCookie *http.Cookie, redirectURL *url.URL) (*http.Cookie, *url.URL) {
+        mismatched := *redirectURL
+        query := mismatched.Query()
+        query.Set("state", "another-state")
+        mismatched.RawQuery = query.Encode()
+        return stateCookie, &mismatched
+      },
+      wantStatus: http.StatusBadRequest,
+    },
+    {
+      // The fake token endpoint checks the verifier against the challenge.
+      name: "wrong code verifier",
+      tamper: func(stateCookie *http.Cookie, redirectURL *url.URL) (*http.Cookie, *url.URL) {
+        return withCodeVerifier(stateCookie, "wrong-verifier"), redirectURL
+      },
+      wantStatus: http.StatusInternalServerError,
+    },
+    {
+      name: "missing code verifier",
+      tamper: func(stateCookie *http.Cookie, redirectURL *url.URL) (*http.Cookie, *url.URL) {
+        return withCodeVerifier(stateCookie, ""), redirectURL
+      },
+      wantStatus: http.StatusInternalServerError,
+    },
+  }
+
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      server := newOAuthTestServer(t)
+      stateCookie, redirectURL := startFakeLogin(t, server)
+
+      stateCookie, redirectURL = test.tamper(stateCookie, redirectURL)
+      resp := finishFakeLogin(t, stateCookie, redirectURL)
+      if resp.StatusCode != test.wantStatus {
+        t.Errorf("Redirect returned %d, want %d", resp.StatusCode, test.wantStatus)
+      }
+      if findCookie(resp, kLoginCookieName) != nil {
+        t.Errorf("The redirect set the %s cookie", kLoginCookieName)
+      }
+    })
+  }
+}
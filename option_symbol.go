@@ -0,0 +1,84 @@
+package main
+
+import (
+  "fmt"
+  "math"
+  "regexp"
+  "strconv"
+  "time"
+)
+
+// The details encoded in an option's symbol.
+type OptionDetails struct {
+  Underlying string `json:"underlying"`
+  PutCall string `json:"putCall"`
+  StrikePrice float64 `json:"strikePrice"`
+  // Expiration is YYYY-MM-DD.
+  Expiration string `json:"expiration"`
+}
+
+// OCC symbols are the root padded to 6 characters, the expiration as YYMMDD,
+// C or P and the strike * 1000 on 8 digits, e.g. "WY    221216P00032000".
+// Schwab uses this format.
+var kOCCSymbolRegexp = regexp.MustCompile(`^([A-Z0-9./]{1,6}) *(\d{6})([CP])(\d{8})$`)
+
+// TDA uses its own format: the root, an underscore, the expiration as MMDDYY,
+// C or P and the strike, e.g. "WY_121622P32.5".
+var kTDAOptionSymbolRegexp = regexp.MustCompile(`^([A-Z0-9./]+)_(\d{6})([CP])(\d+(?:\.\d+)?)$`)
+
+// Returns the number of days until the expiration, negative once it passed.
+func (d *OptionDetails) daysToExpiration() (int, error) {
+  expiration, err := time.Parse("2006-01-02", d.Expiration)
+  if err != nil {
+    return 0, err
+  }
+  return int(math.Ceil(time.Until(expiration).Hours() / 24)), nil
+}
+
+func putCallFromLetter(letter string) string {
+  if letter == "C" {
+    return CALL
+  }
+  return PUT
+}
+
+// Parses an option symbol in either the OCC or TDA format.
+func parseOptionSymbol(symbol string) (*OptionDetails, error) {
+  if match := kOCCSymbolRegexp.FindStringSubmatch(symbol); match != nil {
+    expiration, err := time.Parse("060102", match[2])
+    if err != nil {
+      return nil, err
+    }
+    strike, err := strconv.Atoi(match[4])
+    if err != nil {
+      return nil, err
+    }
+
+    return &OptionDetails{
+      Underlying: match[1],
+      PutCall: putCallFromLetter(match[3]),
+      StrikePrice: float64(strike) / 1000,
+      Expiration: expiration.Format("2006-01-02"),
+    }, nil
+  }
+
+  if match := kTDAOptionSymbolRegexp.FindStringSubmatch(symbol); match != nil {
+    expiration, err := time.Parse("010206", match[2])
+    if err != nil {
+      return nil, err
+    }
+    strike, err := strconv.ParseFloat(match[4], 64)
+    if err != nil {
+      return nil, err
+    }
+
+    return &OptionDetails{
+      Underlying: match[1],
+      PutCall: putCallFromLetter(match[3]),
+      StrikePrice: strike,
+      Expiration: expiration.Format("2006-01-02"),
+    }, nil
+  }
+
+  return nil, fmt.Errorf("Unsupported option symbol: %s", symbol)
+}
@@ -2,14 +2,10 @@ package main
 
 import (
   "container/heap"
-  "encoding/json"
-  "errors"
   "fmt"
-  "io/ioutil"
-  "log"
+  "math"
   "net/http"
-  "strings"
-  "time"
+  "strconv"
 )
 
 const (
@@ -17,33 +13,19 @@ const (
   CALL = "CALL"
 )
 
-// Minimum amount of open interest.
-// TODO: This should be configurable!
-const kMinOpenInterest = 10
-
-func buildOptionURL(symbol, apiKey, putCall string, start, end time.Time) string {
-  var builder strings.Builder
-  builder.Grow(100)
-  builder.WriteString("https://api.tdameritrade.com/v1/marketdata/chains?apikey=")
-  builder.WriteString(apiKey)
-  builder.WriteString("&symbol=")
-  builder.WriteString(symbol)
-  builder.WriteString("&contractType=")
-  builder.WriteString(putCall)
-  builder.WriteString("&strikeCount=5&range=SBK&fromDate=")
-  builder.WriteString(fmt.Sprintf("%d-%d-%d", start.Year(), start.Month(), start.Day()))
-  builder.WriteString("&toDate=")
-  builder.WriteString(fmt.Sprintf("%d-%d-%d", end.Year(), end.Month(), end.Day()))
-  return builder.String()
-}
-
 // This is a cleaned up option from TDA as it returns them in a weird way.
 type Option struct {
   Symbol string `json:"symbol"`
+  // The symbol and price of the underlying stock.
+  Underlying string `json:"underlying"`
+  UnderlyingPrice float64 `json:"underlyingPrice"`
   PutCall string `json:"putcall"`
   StrikePrice float64 `json:"strikePrice"`
   // Expiration is YYYY-MM-DD.
   Expiration string `json:"date"`
+  // True for the standard monthly expirations, false for the weeklies and
+  // the other non-standard ones.
+  MonthlyExpiration bool `json:"monthlyExpiration"`
 
   Bid float64 `json:"bid"`
   BidSize int `json:"bidSize"`
@@ -55,134 +37,199 @@ type Option struct {
   Multiplier float64 `json:"multiplier"`
 
   OpenInterest int `json:"openInterest"`
+  Volume int `json:"volume"`
   DaysToExpiration int `json:"daysToExpiration"`
-}
 
-type tdaOption struct {
-  Symbol string `json:"symbol"`
-  PutCall string `json:"putCall"`
-  Bid float64 `json:"bid"`
-  BidSize int `json:"bidSize"`
-  Ask float64 `json:"ask"`
-  AskSize int `json:"askSize"`
-  Mark float64 `json:"mark"`
-  OpenInterest int `json:"openInterest"`
-  StrikePrice float64 `json:"strikePrice"`
-  DaysToExpiration int `json:"daysToExpiration"`
-  Multiplier float64 `json:"multiplier"`
+  // The greeks, from the broker or computed by priceOption.
+  // Delta is negative for puts, theta is per day and vega per 1% of volatility.
+  Delta float64 `json:"delta"`
+  Gamma float64 `json:"gamma"`
+  Theta float64 `json:"theta"`
+  Vega float64 `json:"vega"`
+  // Annualized, e.g. 0.3 for 30%.
+  ImpliedVolatility float64 `json:"impliedVolatility"`
+  TheoreticalValue float64 `json:"theoreticalValue"`
+  // True if some of the above were computed locally.
+  GreeksComputed bool `json:"greeksComputed"`
+  // True if we couldn't get an implied volatility: the missing greeks are 0.
+  MissingGreeks bool `json:"missingGreeks,omitempty"`
+
+  // Our own price for the option, to cross-check the Mark.
+  // 0 if we couldn't price it.
+  ModelPrice float64 `json:"modelPrice"`
+  // The probability of the option expiring in-the-money.
+  AssignmentProbability float64 `json:"assignmentProbability"`
+
+  // The number of contracts the account can sell (cash-secured for puts,
+  // covered for calls). 0 if unknown.
+  MaxContracts int `json:"maxContracts,omitempty"`
+
+  // Only set for the suggestions.
+  Risk *RiskMetrics `json:"risk,omitempty"`
+
+  // Set by the filtering if the option was rejected.
+  RejectionReason string `json:"rejectionReason,omitempty"`
 }
 
-type tdaOptionByPriceMap map[string][]tdaOption
+// Returns the quote for |symbol| and the part of its option chain described by |chainParams|.
+//
+// The options' UnderlyingPrice is the quote's last price so the filtering
+// is consistent with what we return to the user. The greeks missing from the
+// broker's response are computed with |riskFreeRate|.
+func getSymbolOptions(broker Broker, symbol, putCall string, chainParams *ChainParams, riskFreeRate float64) (*Quote, []Option, error) {
+  quote, options, err := getSymbolChain(broker, symbol, putCall, chainParams)
+  if err != nil {
+    return nil, nil, err
+  }
 
-type tdaOptionByDateMap map[string]tdaOptionByPriceMap
+  for i := range options {
+    priceOption(&options[i], riskFreeRate)
+  }
+  return quote, options, nil
+}
 
-type tdaOptionChainResponse struct {
-  Symbol string `json:"symbol"`
-  Status string `json:"status"`
-  UnderlyingPrice float64 `json:"underlyingPrice"`
-  NumberOfContracts int `json:"numberOfContracts"`
+// Same as getSymbolOptions without pricing the options: the greeks missing
+// from the broker's response are still missing values.
+//
+// Pricing an option is expensive so this is for the callers that only return
+// a few of them, they must call priceOption on those.
+func getSymbolChain(broker Broker, symbol, putCall string, chainParams *ChainParams) (*Quote, []Option, error) {
+  quote, err := broker.GetQuote(symbol)
+  if err != nil {
+    return nil, nil, err
+  }
 
-  PutExpDateMap tdaOptionByDateMap `json:"putExpDateMap"`
-  CallExpDateMap tdaOptionByDateMap `json:"callExpDateMap"`
-}
+  chain, err := broker.GetOptionChain(symbol, putCall, chainParams)
+  if err != nil {
+    return nil, nil, err
+  }
 
-func formatOptionMap(dateMap tdaOptionByDateMap, size int) []Option {
-  options := make([]Option, 0, size)
-  for expiration, optionsByPrice := range dateMap {
-    // Expiration contains the time and the days to expiration.
-    // We drop the latter part here.
-    expiration, _, _ := strings.Cut(expiration, ":")
-    for price, maybeOptions := range optionsByPrice {
-      if len(maybeOptions) == 0 || len(maybeOptions) > 1 {
-        // TODO: Thread through the PUT/CALL.
-        log.Printf("[FATAL] Invalid number of options for: %s - %d", expiration, price)
-        panic("Unsupported format")
-      }
-      option := maybeOptions[0]
-
-      options = append(options, Option{
-        Symbol: option.Symbol,
-        PutCall: option.PutCall,
-        StrikePrice: option.StrikePrice,
-        Expiration: expiration,
-        Bid: option.Bid,
-        BidSize: option.BidSize,
-        Ask: option.Ask,
-        AskSize: option.AskSize,
-        Mark: option.Mark,
-
-        OpenInterest: option.OpenInterest,
-        DaysToExpiration: option.DaysToExpiration,
-        Multiplier: option.Multiplier,
-      })
+  // The brokers can't filter the weekly/monthly expirations.
+  options := make([]Option, 0, len(chain))
+  for _, option := range chain {
+    if !chainParams.matchesExpiration(option) {
+      continue
     }
-  }
 
-  return options
+    option.Underlying = symbol
+    option.UnderlyingPrice = quote.LastPrice
+    options = append(options, option)
+  }
+  return quote, options, nil
 }
 
-func formatResponse(response tdaOptionChainResponse, putCall string) ([]Option, error) {
-  switch(putCall) {
-  case PUT:
-    return formatOptionMap(response.PutExpDateMap, response.NumberOfContracts), nil
-  case CALL:
-    return formatOptionMap(response.CallExpDateMap, response.NumberOfContracts), nil
-  default:
-    panic("Unknown value for putCall: " + putCall)
-  }
+// Filtering and sorting
+
+// The parameters for picking suggestions out of an option chain.
+type SuggestionParams struct {
+  Filters *OptionFilters
+  Ranker Ranker
+  // The number of suggestions to return.
+  Count int
+
+  // The cash we can use as collateral for puts.
+  // This is +Inf if we don't know the account's balance.
+  Balance float64
+  // The percentage of the account's cash to keep aside.
+  CashReservePercent float64
+  // The number of contracts we want to sell.
+  Contracts int
 }
 
-func GetOptionChain(symbol, apiKey, putCall string, start, end time.Time) ([]Option, error) {
-  url := buildOptionURL(symbol, apiKey, putCall, start, end)
-  log.Printf("[INFO] Calling %s to get options", url)
+// Parses the suggestion parameters from |req|, starting from the user's |preferences|.
+//
+// The balance is unlimited, see setBalanceFromAccount.
+func getSuggestionParams(req *http.Request, preferences *Preferences) (*SuggestionParams, error) {
+  query := req.URL.Query()
+  ranker, count, err := parseRankingParams(query, preferences.Rank)
+  if err != nil {
+    return nil, err
+  }
 
-  resp, err := http.Get(url)
+  filters, err := getRequestFilters(req, preferences)
   if err != nil {
-    return []Option{}, err
+    return nil, err
   }
 
-  defer resp.Body.Close()
-  body, err := ioutil.ReadAll(resp.Body)
-  log.Printf("[INFO] Got response from %s", body)
+  params := &SuggestionParams{
+    Filters: filters,
+    Ranker: ranker,
+    Count: count,
+    Balance: math.Inf(1),
+    CashReservePercent: preferences.CashReservePercent,
+    Contracts: 1,
+  }
 
-  var option_response tdaOptionChainResponse
-  err = json.Unmarshal(body, &option_response)
-  if err != nil {
-    return []Option{}, err
+  if reserveParam := query.Get("cash_reserve_percent"); reserveParam != "" {
+    params.CashReservePercent, err = strconv.ParseFloat(reserveParam, 64)
+    if err != nil || params.CashReservePercent < 0 || params.CashReservePercent >= 100 {
+      return nil, fmt.Errorf("Invalid cash_reserve_percent: %s", reserveParam)
+    }
   }
 
-  log.Printf("[INFO] Parsed response %+v", option_response)
-  if option_response.Status != "SUCCESS" {
-    return []Option{}, errors.New("Called failed")
+  if contractsParam := query.Get("contracts"); contractsParam != "" {
+    params.Contracts, err = strconv.Atoi(contractsParam)
+    if err != nil || params.Contracts <= 0 {
+      return nil, fmt.Errorf("Invalid contracts: %s", contractsParam)
+    }
   }
 
-  return formatResponse(option_response, putCall)
+  return params, nil
 }
 
-// Filtering and sorting
+// Constrains the balance to the cash available in |accountId|, minus the
+// reserve and the collateral of the working put orders, like the orders
+// endpoint does. This is a no-op if there is no logged in user (empty |accountId|).
+func (p *SuggestionParams) setBalanceFromAccount(broker Broker, accountId string) error {
+  if accountId == "" {
+    return nil
+  }
+
+  userAccountInfo, err := broker.GetUserAccountInfo(accountId)
+  if err != nil {
+    return err
+  }
+  orders, err := broker.GetOrders(accountId)
+  if err != nil {
+    return err
+  }
+
+  p.Balance = math.Max(availablePutCollateral(userAccountInfo, orders, p.CashReservePercent), 0)
+  return nil
+}
 
-// The OptionProfitHeap is a max-heap of ints.
-type OptionProfitHeap []Option
+// Returns the balance for the responses, nil if it is unlimited.
+func (p *SuggestionParams) balanceForResponse() *float64 {
+  if math.IsInf(p.Balance, 1) {
+    return nil
+  }
+  return &p.Balance
+}
 
-func (h OptionProfitHeap) Len() int { return len(h) }
-func (h OptionProfitHeap) Less(i, j int) bool {
-  profitI := -h[i].Mark / float64(h[i].DaysToExpiration)
-  profitJ := -h[j].Mark / float64(h[j].DaysToExpiration)
-  return profitI < profitJ
+
+// The RankedOptionHeap is a max-heap of options, ordered by the ranker's score.
+type RankedOptionHeap struct {
+  options []Option
+  ranker Ranker
 }
-func (h OptionProfitHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
 
-func (h *OptionProfitHeap) Push(x any) {
+func (h RankedOptionHeap) Len() int { return len(h.options) }
+func (h RankedOptionHeap) Less(i, j int) bool {
+  return h.ranker.Score(h.options[i]) > h.ranker.Score(h.options[j])
+}
+func (h RankedOptionHeap) Swap(i, j int) { h.options[i], h.options[j] = h.options[j], h.options[i] }
+
+func (h *RankedOptionHeap) Push(x any) {
 	// Push and Pop use pointer receivers because they modify the slice's length,
 	// not just its contents.
-	*h = append(*h, x.(Option))
+	h.options = append(h.options, x.(Option))
 }
 
-func (h *OptionProfitHeap) Pop() any {
-	old := *h
+func (h *RankedOptionHeap) Pop() any {
+	old := h.options
 	n := len(old)
 	x := old[n-1]
-	*h = old[0 : n-1]
+	h.options = old[0 : n-1]
 	return x
 }
 
@@ -193,33 +240,87 @@ func min(a, b int) int {
     return b
 }
 
-func FilterOptions(balance, stockPrice float64, options []Option) []Option {
-  h := new(OptionProfitHeap)
-  for _, option := range options {
+// Returns the best puts to sell according to |params|.
+//
+// The rejected options are annotated in place with the reason they were
+// filtered out.
+func FilterOptions(options []Option, params *SuggestionParams) []Option {
+  h := &RankedOptionHeap{ranker: params.Ranker}
+  for i := range options {
+    option := &options[i]
     // Sanity check.
-    if option.PutCall != "PUT" {
+    if option.PutCall != PUT {
       panic("Unsupported option, this only supports PUT right now!")
     }
 
-    cost := option.StrikePrice * option.Multiplier
-    if cost > balance {
+    collateral := option.StrikePrice * option.Multiplier
+    // Bad data from the broker, this would divide by 0 below.
+    if collateral <= 0 {
+      option.RejectionReason = "Invalid strike or multiplier"
+      continue
+    }
+    if collateral * float64(params.Contracts) > params.Balance {
+      option.RejectionReason = fmt.Sprintf("Not enough cash to cover %d contract(s)", params.Contracts)
+      continue
+    }
+    if !math.IsInf(params.Balance, 1) {
+      option.MaxContracts = int(math.Floor(params.Balance / collateral))
+    }
+
+    option.RejectionReason = params.Filters.rejectionReason(*option)
+    if option.RejectionReason != "" {
+      continue
+    }
+
+    heap.Push(h, *option)
+  }
+
+  return popTopSuggestions(h, params.Count)
+}
+
+// Returns the best options for selling covered calls against |position|.
+//
+// We only consider calls at or above the cost basis so an assignment doesn't
+// lock in a loss, and need enough shares to cover at least one contract.
+// Like FilterOptions, the rejected options are annotated in place.
+func FilterCoveredCalls(position Position, uncoveredShares float64, options []Option, params *SuggestionParams) []Option {
+  h := &RankedOptionHeap{ranker: params.Ranker}
+  for i := range options {
+    option := &options[i]
+    // Sanity check.
+    if option.PutCall != CALL {
+      panic("Unsupported option, only CALL can be covered!")
+    }
+
+    // Bad data from the broker, this would divide by 0 below.
+    if option.Multiplier <= 0 {
+      option.RejectionReason = "Invalid multiplier"
       continue
     }
+    if uncoveredShares < option.Multiplier * float64(params.Contracts) {
+      option.RejectionReason = fmt.Sprintf("Not enough uncovered shares to cover %d contract(s)", params.Contracts)
+      continue
+    }
+    option.MaxContracts = int(math.Floor(uncoveredShares / option.Multiplier))
 
-    if option.OpenInterest < kMinOpenInterest {
+    if option.StrikePrice < position.AveragePrice {
+      option.RejectionReason = "Strike is below the cost basis"
       continue
     }
 
-    // Ignore options above the stock price.
-    if option.StrikePrice > stockPrice {
-      continue;
+    option.RejectionReason = params.Filters.rejectionReason(*option)
+    if option.RejectionReason != "" {
+      continue
     }
 
-    heap.Push(h, option)
+    heap.Push(h, *option)
   }
 
-  // Pick the top 3.
-  topSuggestionSize := min(len(*h), 3)
+  return popTopSuggestions(h, params.Count)
+}
+
+func popTopSuggestions(h *RankedOptionHeap, count int) []Option {
+  topSuggestionSize := min(h.Len(), count)
   suggestions := make([]Option, topSuggestionSize)
   for i := 0; i < topSuggestionSize; i++ {
     suggestions[i] = heap.Pop(h).(Option)
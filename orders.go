@@ -0,0 +1,441 @@
+package main
+
+import (
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io/ioutil"
+  "log"
+  "math"
+  "net/http"
+  "strings"
+)
+
+// Order instructions.
+const (
+  kSellToOpen = "SELL_TO_OPEN"
+  kBuyToClose = "BUY_TO_CLOSE"
+)
+
+// A single-leg limit order on an option.
+type Order struct {
+  // Set once the broker accepted the order.
+  OrderId string `json:"orderId,omitempty"`
+  AccountId string `json:"accountId"`
+
+  // One of the order instructions above.
+  Instruction string `json:"instruction"`
+  OptionSymbol string `json:"optionSymbol"`
+  Contracts int `json:"contracts"`
+  // The limit price per share.
+  LimitPrice float64 `json:"limitPrice"`
+  // The order is valid for the day.
+  Duration string `json:"duration"`
+
+  // Only set for orders returned by the broker.
+  Status string `json:"status,omitempty"`
+  FilledContracts int `json:"filledContracts,omitempty"`
+  EnteredTime string `json:"enteredTime,omitempty"`
+}
+
+// The order statuses we act on. The brokers have many more intermediate ones
+// (QUEUED, PENDING_ACTIVATION...) which we consider open.
+const (
+  kOrderWorking = "WORKING"
+  kOrderFilled = "FILLED"
+  kOrderCanceled = "CANCELED"
+  kOrderReplaced = "REPLACED"
+  kOrderRejected = "REJECTED"
+  kOrderExpired = "EXPIRED"
+)
+
+// How far back we list the orders.
+const kOrdersLookbackDays = 30
+
+// Whether the order can still be cancelled or replaced.
+func (o *Order) IsOpen() bool {
+  switch o.Status {
+  case kOrderFilled, kOrderCanceled, kOrderReplaced, kOrderRejected, kOrderExpired:
+    return false
+  default:
+    return true
+  }
+}
+
+type placeOrderRequest struct {
+  OptionSymbol string `json:"optionSymbol"`
+  Contracts int `json:"contracts"`
+  // Defaults to the option's Mark.
+  LimitPrice float64 `json:"limitPrice"`
+  // Only validate and return the order, without sending it to the broker.
+  DryRun bool `json:"dryRun"`
+}
+
+type placeOrderResponse struct {
+  Order Order `json:"order"`
+  // The cash (for puts) or shares (for calls) needed to cover the order.
+  Collateral float64 `json:"collateral"`
+  DryRun bool `json:"dryRun"`
+}
+
+// Returned by the order validation. This is a client error.
+type invalidOrderError struct {
+  msg string
+}
+
+func (e *invalidOrderError) Error() string {
+  return e.msg
+}
+
+// Limit prices are in cents.
+func roundToCents(price float64) float64 {
+  return math.Round(price * 100) / 100
+}
+
+// The options' minimum price increment: $0.05 under $3, $0.10 above.
+// Some options trade in pennies but they all accept these increments.
+func tickSize(price float64) float64 {
+  if price < 3 {
+    return 0.05
+  }
+  return 0.10
+}
+
+// Rounds |price| to the nearest tick.
+func roundToTick(price float64) float64 {
+  tick := tickSize(price)
+  return roundToCents(math.Round(price / tick) * tick)
+}
+
+// Rounds |price| down to a tick.
+func floorToTick(price float64) float64 {
+  tick := tickSize(price)
+  // The epsilon avoids going one tick down due to floating point errors.
+  return roundToCents(math.Floor(price / tick + 1e-9) * tick)
+}
+
+// Finds the option for |symbol| in its chain.
+func findOption(broker Broker, symbol string, details *OptionDetails, riskFreeRate float64) (*Option, error) {
+  daysToExpiration, err := details.daysToExpiration()
+  if err != nil {
+    return nil, err
+  }
+  if daysToExpiration < 0 {
+    return nil, &invalidOrderError{"The option has expired"}
+  }
+
+  chainParams := &ChainParams{
+    MinDaysToExpiration: daysToExpiration - 1,
+    MaxDaysToExpiration: daysToExpiration + 1,
+    Range: "ALL",
+    Expirations: kAllExpirations,
+  }
+  if chainParams.MinDaysToExpiration < 0 {
+    chainParams.MinDaysToExpiration = 0
+  }
+  _, options, err := getSymbolChain(broker, details.Underlying, details.PutCall, chainParams)
+  if err != nil {
+    return nil, err
+  }
+
+  for _, option := range options {
+    if option.Symbol == symbol {
+      priceOption(&option, riskFreeRate)
+      return &option, nil
+    }
+  }
+  return nil, &invalidOrderError{"Unknown option " + symbol}
+}
+
+// Same as findOption for an option symbol coming from the user.
+func lookupOption(broker Broker, symbol string, riskFreeRate float64) (*Option, error) {
+  details, err := parseOptionSymbol(symbol)
+  if err != nil {
+    return nil, &invalidOrderError{err.Error()}
+  }
+  return findOption(broker, symbol, details, riskFreeRate)
+}
+
+// Returns the cash needed to cover the open sell-to-open put |orders|.
+func openPutsCollateral(orders []Order) float64 {
+  collateral := 0.
+  for _, order := range orders {
+    if !order.IsOpen() || order.Instruction != kSellToOpen {
+      continue
+    }
+    details, err := parseOptionSymbol(order.OptionSymbol)
+    if err != nil || details.PutCall != PUT {
+      continue
+    }
+    // The filled contracts are already accounted for in the cash.
+    collateral += details.StrikePrice * kSharesPerContract * float64(order.Contracts - order.FilledContracts)
+  }
+  return collateral
+}
+
+// Returns the cash the account can still use as collateral for new puts:
+// its cash minus |cashReservePercent| and the collateral of its open |orders|.
+// This can be negative.
+func availablePutCollateral(userAccountInfo *UserAccountInfo, orders []Order, cashReservePercent float64) float64 {
+  return userAccountInfo.CashAvailableForTrading * (1 - cashReservePercent / 100) - openPutsCollateral(orders)
+}
+
+// Checks that the account can cover selling |order| for |option|, on top of
+// its open |orders| and keeping |cashReservePercent| of its cash aside.
+// Returns the collateral needed.
+func validateSellToOpen(order *Order, option *Option, userAccountInfo *UserAccountInfo, orders []Order, cashReservePercent float64) (float64, error) {
+  if option.PutCall == PUT {
+    collateral := option.StrikePrice * option.Multiplier * float64(order.Contracts)
+    available := availablePutCollateral(userAccountInfo, orders, cashReservePercent)
+    if collateral > available {
+      return 0, &invalidOrderError{fmt.Sprintf("Not enough cash: %.2f needed, %.2f available", collateral, math.Max(available, 0))}
+    }
+    return collateral, nil
+  }
+
+  shares := option.Multiplier * float64(order.Contracts)
+  if userAccountInfo.UncoveredShares(option.Underlying, orders) < shares {
+    return 0, &invalidOrderError{fmt.Sprintf("Not enough uncovered %s shares to cover %d call(s)", option.Underlying, order.Contracts)}
+  }
+  return shares, nil
+}
+
+// Builds (and unless it is a dry-run, places) a sell-to-open limit order.
+// |cashReservePercent| of the account's cash is kept aside when selling puts.
+func placeSellToOpenOrder(broker Broker, accountId string, orderReq *placeOrderRequest, riskFreeRate, cashReservePercent float64) (*placeOrderResponse, error) {
+  option, err := lookupOption(broker, orderReq.OptionSymbol, riskFreeRate)
+  if err != nil {
+    return nil, err
+  }
+  return sellToOpen(broker, accountId, option, orderReq, cashReservePercent)
+}
+
+// Same as placeSellToOpenOrder for an option we already looked up.
+func sellToOpen(broker Broker, accountId string, option *Option, orderReq *placeOrderRequest, cashReservePercent float64) (*placeOrderResponse, error) {
+  if orderReq.Contracts <= 0 {
+    return nil, &invalidOrderError{"contracts must be positive"}
+  }
+  if orderReq.LimitPrice < 0 {
+    return nil, &invalidOrderError{"limitPrice can't be negative"}
+  }
+
+  order := Order{
+    AccountId: accountId,
+    Instruction: kSellToOpen,
+    OptionSymbol: option.Symbol,
+    Contracts: orderReq.Contracts,
+    LimitPrice: orderReq.LimitPrice,
+    Duration: "DAY",
+  }
+  if order.LimitPrice == 0 {
+    order.LimitPrice = option.Mark
+  }
+  order.LimitPrice = roundToTick(order.LimitPrice)
+  if order.LimitPrice <= 0 {
+    return nil, &invalidOrderError{"The option has no price, set a positive limitPrice"}
+  }
+
+  userAccountInfo, err := broker.GetUserAccountInfo(accountId)
+  if err != nil {
+    return nil, err
+  }
+  orders, err := broker.GetOrders(accountId)
+  if err != nil {
+    return nil, err
+  }
+  collateral, err := validateSellToOpen(&order, option, userAccountInfo, orders, cashReservePercent)
+  if err != nil {
+    return nil, err
+  }
+
+  resp := &placeOrderResponse{
+    Order: order,
+    Collateral: collateral,
+    DryRun: orderReq.DryRun,
+  }
+  if orderReq.DryRun {
+    return resp, nil
+  }
+
+  resp.Order.OrderId, err = broker.PlaceOrder(accountId, &order)
+  if err != nil {
+    return nil, err
+  }
+  log.Printf("[INFO] Placed order %s: %+v", resp.Order.OrderId, order)
+  return resp, nil
+}
+
+type replaceOrderRequest struct {
+  LimitPrice float64 `json:"limitPrice"`
+}
+
+type ordersHandlerResponse struct {
+  Orders []Order `json:"orders"`
+}
+
+func cancelOrder(broker Broker, accountId, orderId string) error {
+  order, err := broker.GetOrder(accountId, orderId)
+  if err != nil {
+    return err
+  }
+  if !order.IsOpen() {
+    return &invalidOrderError{fmt.Sprintf("Order %s is %s", orderId, order.Status)}
+  }
+
+  if err := broker.CancelOrder(accountId, orderId); err != nil {
+    return err
+  }
+  log.Printf("[INFO] Cancelled order %s", orderId)
+  return nil
+}
+
+// Replaces the limit price of the open order |orderId|.
+// Returns the new order.
+func replaceOrderPrice(broker Broker, accountId, orderId string, limitPrice float64) (*Order, error) {
+  limitPrice = roundToTick(limitPrice)
+  if limitPrice <= 0 {
+    return nil, &invalidOrderError{"limitPrice must be positive"}
+  }
+
+  order, err := broker.GetOrder(accountId, orderId)
+  if err != nil {
+    return nil, err
+  }
+  if !order.IsOpen() {
+    return nil, &invalidOrderError{fmt.Sprintf("Order %s is %s", orderId, order.Status)}
+  }
+
+  replacement := *order
+  replacement.OrderId = ""
+  replacement.Status = ""
+  replacement.FilledContracts = 0
+  replacement.EnteredTime = ""
+  // Only the remaining contracts are replaced.
+  replacement.Contracts = order.Contracts - order.FilledContracts
+  replacement.LimitPrice = limitPrice
+
+  newOrderId, err := broker.ReplaceOrder(accountId, orderId, &replacement)
+  if err != nil {
+    return nil, err
+  }
+  log.Printf("[INFO] Replaced order %s by %s at %.2f", orderId, newOrderId, replacement.LimitPrice)
+  return broker.GetOrder(accountId, newOrderId)
+}
+
+// Maps the errors from the order calls to the right status.
+func writeOrderError(w http.ResponseWriter, err error) {
+  var invalidOrder *invalidOrderError
+  switch {
+  case errors.As(err, &invalidOrder):
+    http.Error(w, invalidOrder.Error(), http.StatusBadRequest)
+  case errors.Is(err, errNotLoggedIn):
+    http.Error(w, "Login required", http.StatusUnauthorized)
+  case isNotFound(err):
+    http.Error(w, "Unknown order", http.StatusNotFound)
+  default:
+    log.Printf("[ERROR] Order call failed (err = %+v)", err)
+    http.Error(w, "Internal Error", http.StatusInternalServerError)
+  }
+}
+
+// Handles /orders and /orders/<orderId> for the logged in user:
+//   GET /orders lists the recent orders.
+//   POST /orders places a sell-to-open order.
+//   GET /orders/<orderId> returns the order.
+//   DELETE /orders/<orderId> cancels the order.
+//   PUT /orders/<orderId> replaces the order's limit price.
+func ordersHandler(w http.ResponseWriter, req *http.Request) {
+  logRequest(req)
+
+  session, accountId := getRequestAccount(w, req)
+  if session == nil {
+    return
+  }
+
+  settings, err := getAppSettings()
+  if err != nil {
+    log.Printf("[ERROR] Failed getting the app settings (err = %+v)", err)
+    http.Error(w, "Internal Error", http.StatusInternalServerError)
+    return
+  }
+
+  broker := getBroker(settings, session)
+  orderId := strings.Trim(strings.TrimPrefix(req.URL.Path, "/orders"), "/")
+  if orderId != "" {
+    orderHandler(w, req, broker, accountId, orderId)
+    return
+  }
+
+  switch req.Method {
+  case http.MethodGet:
+    orders, err := broker.GetOrders(accountId)
+    if err != nil {
+      writeOrderError(w, err)
+      return
+    }
+    writeJSON(w, ordersHandlerResponse{orders})
+  case http.MethodPost:
+    placeOrderHandler(w, req, broker, accountId, settings.riskFreeRate(), getSessionPreferences(session).CashReservePercent)
+  default:
+    http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+  }
+}
+
+func orderHandler(w http.ResponseWriter, req *http.Request, broker Broker, accountId, orderId string) {
+  switch req.Method {
+  case http.MethodGet:
+    order, err := broker.GetOrder(accountId, orderId)
+    if err != nil {
+      writeOrderError(w, err)
+      return
+    }
+    writeJSON(w, order)
+  case http.MethodDelete:
+    if err := cancelOrder(broker, accountId, orderId); err != nil {
+      writeOrderError(w, err)
+      return
+    }
+    w.WriteHeader(http.StatusNoContent)
+  case http.MethodPut:
+    body, err := ioutil.ReadAll(req.Body)
+    if err != nil {
+      http.Error(w, "Couldn't read body", http.StatusBadRequest)
+      return
+    }
+    var replaceReq replaceOrderRequest
+    if err := json.Unmarshal(body, &replaceReq); err != nil {
+      http.Error(w, "Invalid replacement", http.StatusBadRequest)
+      return
+    }
+
+    order, err := replaceOrderPrice(broker, accountId, orderId, replaceReq.LimitPrice)
+    if err != nil {
+      writeOrderError(w, err)
+      return
+    }
+    writeJSON(w, order)
+  default:
+    http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+  }
+}
+
+func placeOrderHandler(w http.ResponseWriter, req *http.Request, broker Broker, accountId string, riskFreeRate, cashReservePercent float64) {
+  body, err := ioutil.ReadAll(req.Body)
+  if err != nil {
+    http.Error(w, "Couldn't read body", http.StatusBadRequest)
+    return
+  }
+  orderReq := new(placeOrderRequest)
+  if err := json.Unmarshal(body, orderReq); err != nil {
+    http.Error(w, "Invalid order", http.StatusBadRequest)
+    return
+  }
+
+  resp, err := placeSellToOpenOrder(broker, accountId, orderReq, riskFreeRate, cashReservePercent)
+  if err != nil {
+    writeOrderError(w, err)
+    return
+  }
+
+  writeJSON(w, resp)
+}
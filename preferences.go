@@ -0,0 +1,333 @@
+package main
+
+import (
+  "encoding/json"
+  "fmt"
+  "io/ioutil"
+  "log"
+  "net/http"
+  "sort"
+  "time"
+)
+
+// A user of the app, keyed by a random ID. Their accounts are linked to them,
+// see UserAccount.
+//
+// All the per-user state lives in the preferences: /user/preferences returns
+// and replaces all of them while /watchlist, /filters and /chain_params only
+// deal with their part. They are the user's defaults for the suggestions and
+// are applied in this order, each one overriding the previous:
+//   1. Our built-in defaults.
+//   2. The user's preferences.
+//   3. The query parameters.
+type User struct {
+  CreatedAt time.Time `json:"createdAt" datastore:",noindex"`
+  LastLoginAt time.Time `json:"lastLoginAt" datastore:",noindex"`
+  Preferences Preferences `json:"preferences" datastore:",noindex"`
+}
+
+// The zero value means no preferences.
+type Preferences struct {
+  // The symbols to show by default, /options uses the first one.
+  DefaultSymbols []string `json:"defaultSymbols" datastore:",noindex"`
+  // The symbols scanned by /scan.
+  Watchlist []string `json:"watchlist" datastore:",noindex"`
+  // nil to use defaultOptionFilters.
+  Filters *OptionFilters `json:"filters" datastore:",noindex"`
+  // One of kRankers, "" for kDefaultRanker.
+  Rank string `json:"rank" datastore:",noindex"`
+  // The days to expiration window and the strikes to consider.
+  // nil to use defaultChainParams.
+  ChainParams *ChainParams `json:"chainParams" datastore:",noindex"`
+  // The percentage of the account's cash to keep aside.
+  CashReservePercent float64 `json:"cashReservePercent" datastore:",noindex"`
+}
+
+const kUsersTable string = "User"
+
+// Links an account to its user, keyed by the account ID.
+//
+// The brokers don't give us a stable identity for the user and the accounts a
+// login gives access to change: Schwab lets the user pick them and accounts
+// are opened and closed. All the accounts of a login are linked to the same
+// user so any of them finds it again.
+type UserAccount struct {
+  UserId string `datastore:",noindex"`
+}
+
+const kUserAccountsTable string = "UserAccount"
+
+// Returns the user |userId| read in |tx|, a new one if there is no such user.
+func getUserInTransaction(tx EntityTransaction, userId string) (*User, error) {
+  user := new(User)
+  found, err := tx.Get(kUsersTable, userId, user)
+  if err != nil {
+    return nil, err
+  }
+  if !found {
+    // The user logged in before we had users.
+    user = &User{CreatedAt: time.Now()}
+  }
+  return user, nil
+}
+
+// Returns the user |userId|, nil if there is no such user.
+func getUser(userId string) (*User, error) {
+  user := new(User)
+  found, err := entityStore.Get(kUsersTable, userId, user)
+  if err != nil {
+    return nil, err
+  }
+  if !found {
+    return nil, nil
+  }
+  return user, nil
+}
+
+// Returns the preferences of the user |userId|, empty if they have none.
+func getUserPreferences(userId string) (*Preferences, error) {
+  user, err := getUser(userId)
+  if err != nil {
+    return nil, err
+  }
+  if user == nil {
+    return &Preferences{}, nil
+  }
+  return &user.Preferences, nil
+}
+
+// Lets |update| change the preferences of the user |userId| and saves them,
+// atomically. |update| can be called more than once.
+// Returns the updated preferences.
+func updateUserPreferences(userId string, update func(preferences *Preferences)) (*Preferences, error) {
+  var user *User
+  err := entityStore.RunInTransaction(func(tx EntityTransaction) error {
+    var err error
+    user, err = getUserInTransaction(tx, userId)
+    if err != nil {
+      return err
+    }
+
+    update(&user.Preferences)
+    return tx.Put(kUsersTable, userId, user)
+  })
+  if err != nil {
+    return nil, err
+  }
+  return &user.Preferences, nil
+}
+
+// Records the login of the user that has access to |accountIds| and returns
+// their ID.
+//
+// The user is the one linked to any of the accounts, or a new one if none is.
+// All of |accountIds| are then linked to that user.
+func recordUserLogin(accountIds []string) (string, error) {
+  // Only used if none of the accounts is linked. We generate it outside of
+  // the transaction as it can be retried.
+  newUserId, err := newRandomString()
+  if err != nil {
+    return "", err
+  }
+
+  // Sorted so the same user is picked whatever order the broker returns.
+  sortedIds := append([]string{}, accountIds...)
+  sort.Strings(sortedIds)
+
+  var userId string
+  err = entityStore.RunInTransaction(func(tx EntityTransaction) error {
+    userId = ""
+    for _, accountId := range sortedIds {
+      link := new(UserAccount)
+      found, err := tx.Get(kUserAccountsTable, accountId, link)
+      if err != nil {
+        return err
+      }
+      if !found {
+        continue
+      }
+      if userId == "" {
+        userId = link.UserId
+      } else if link.UserId != userId {
+        log.Printf("[WARN] Account %s moves from user %s to %s", accountId, link.UserId, userId)
+      }
+    }
+    if userId == "" {
+      userId = newUserId
+    }
+
+    user, err := getUserInTransaction(tx, userId)
+    if err != nil {
+      return err
+    }
+    user.LastLoginAt = time.Now()
+    if err := tx.Put(kUsersTable, userId, user); err != nil {
+      return err
+    }
+    for _, accountId := range sortedIds {
+      if err := tx.Put(kUserAccountsTable, accountId, &UserAccount{UserId: userId}); err != nil {
+        return err
+      }
+    }
+    return nil
+  })
+  if err != nil {
+    return "", err
+  }
+  return userId, nil
+}
+
+// Returns the ID of the session's User.
+func (s *Session) userId() string {
+  // Sessions from before we had users. They expire after kSessionDuration.
+  if s.UserId == "" {
+    return s.AccountId
+  }
+  return s.UserId
+}
+
+// Returns the preferences of the user of |session|.
+// They are empty if the user isn't logged in (nil session) or has none.
+func getSessionPreferences(session *Session) *Preferences {
+  if session == nil {
+    return &Preferences{}
+  }
+
+  preferences, err := getUserPreferences(session.userId())
+  if err != nil {
+    // Don't fail the request, the defaults are fine.
+    log.Printf("[WARN] Failed to get the user's preferences (err = %+v)", err)
+    return &Preferences{}
+  }
+  return preferences
+}
+
+// Returns the symbol to use when the request doesn't have one.
+func (p *Preferences) defaultSymbol() string {
+  if len(p.DefaultSymbols) == 0 {
+    return kDefaultSymbol
+  }
+  return p.DefaultSymbols[0]
+}
+
+// Returns the filters to start from.
+func (p *Preferences) optionFilters() *OptionFilters {
+  if p.Filters == nil {
+    return defaultOptionFilters()
+  }
+  filters := *p.Filters
+  return &filters
+}
+
+// Returns the chain parameters to start from.
+func (p *Preferences) chainParams() *ChainParams {
+  if p.ChainParams == nil {
+    return defaultChainParams()
+  }
+  params := *p.ChainParams
+  return &params
+}
+
+// Validates the preferences and normalizes the symbols.
+func (p *Preferences) validate() error {
+  if p.DefaultSymbols == nil {
+    p.DefaultSymbols = []string{}
+  }
+  symbols, valid := normalizeSymbols(p.DefaultSymbols)
+  if !valid {
+    return fmt.Errorf("Invalid symbol in defaultSymbols")
+  }
+  if len(symbols) > kMaxWatchlistSize {
+    return fmt.Errorf("Too many symbols in defaultSymbols")
+  }
+  p.DefaultSymbols = symbols
+
+  if p.Watchlist == nil {
+    p.Watchlist = []string{}
+  }
+  watchlist, valid := normalizeSymbols(p.Watchlist)
+  if !valid {
+    return fmt.Errorf("Invalid symbol in watchlist")
+  }
+  if len(watchlist) > kMaxWatchlistSize {
+    return fmt.Errorf("Too many symbols in watchlist")
+  }
+  p.Watchlist = watchlist
+
+  if p.Filters != nil {
+    if err := p.Filters.validate(); err != nil {
+      return err
+    }
+  }
+  if p.Rank != "" {
+    if _, exists := kRankers[p.Rank]; !exists {
+      return fmt.Errorf("Unknown rank: %s", p.Rank)
+    }
+  }
+  if p.ChainParams != nil {
+    if err := p.ChainParams.validate(); err != nil {
+      return err
+    }
+  }
+  if p.CashReservePercent < 0 || p.CashReservePercent >= 100 {
+    return fmt.Errorf("Invalid cashReservePercent: %v", p.CashReservePercent)
+  }
+  return nil
+}
+
+// GET returns the preferences of the logged in user, PUT replaces them.
+func preferencesHandler(w http.ResponseWriter, req *http.Request) {
+  logRequest(req)
+
+  session, err := getLoginSession(req)
+  if err != nil {
+    http.Error(w, "Login required", http.StatusUnauthorized)
+    return
+  }
+  userId := session.userId()
+
+  switch req.Method {
+  case http.MethodGet:
+    preferences, err := getUserPreferences(userId)
+    if err != nil {
+      log.Printf("[ERROR] Failed to get the preferences (err = %+v)", err)
+      http.Error(w, "Internal Error", http.StatusInternalServerError)
+      return
+    }
+    if preferences.DefaultSymbols == nil {
+      preferences.DefaultSymbols = []string{}
+    }
+    if preferences.Watchlist == nil {
+      preferences.Watchlist = []string{}
+    }
+    writeJSON(w, preferences)
+  case http.MethodPut:
+    body, err := ioutil.ReadAll(req.Body)
+    if err != nil {
+      http.Error(w, "Couldn't read body", http.StatusBadRequest)
+      return
+    }
+
+    newPreferences := Preferences{}
+    if err := json.Unmarshal(body, &newPreferences); err != nil {
+      http.Error(w, "Invalid preferences", http.StatusBadRequest)
+      return
+    }
+    if err := newPreferences.validate(); err != nil {
+      http.Error(w, err.Error(), http.StatusBadRequest)
+      return
+    }
+
+    preferences, err := updateUserPreferences(userId, func(preferences *Preferences) {
+      *preferences = newPreferences
+    })
+    if err != nil {
+      log.Printf("[ERROR] Failed to save the preferences (err = %+v)", err)
+      http.Error(w, "Internal Error", http.StatusInternalServerError)
+      return
+    }
+    writeJSON(w, preferences)
+  default:
+    http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+  }
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+  "testing"
+)
+
+func TestRecordUserLogin(t *testing.T) {
+  oldEntityStore := entityStore
+  entityStore = newMemoryEntityStore()
+  t.Cleanup(func() { entityStore = oldEntityStore })
+
+  login := func(accountIds ...string) string {
+    userId, err := recordUserLogin(accountIds)
+    if err != nil {
+      t.Fatalf("recordUserLogin(%v) failed: %v", accountIds, err)
+    }
+    return userId
+  }
+
+  userId := login("111", "222")
+  if _, err := updateUserPreferences(userId, func(preferences *Preferences) {
+    preferences.Watchlist = []string{"F"}
+  }); err != nil {
+    t.Fatalf("updateUserPreferences failed: %v", err)
+  }
+
+  // The broker's order and the subset of accounts don't matter.
+  if got := login("222", "111"); got != userId {
+    t.Errorf("Login with the accounts reordered got user %q, want %q", got, userId)
+  }
+  if got := login("222"); got != userId {
+    t.Errorf("Login with a subset of the accounts got user %q, want %q", got, userId)
+  }
+  // A new account is linked to the user, so it is found once the old ones are closed.
+  if got := login("222", "333"); got != userId {
+    t.Errorf("Login with a new account got user %q, want %q", got, userId)
+  }
+  if got := login("333"); got != userId {
+    t.Errorf("Login with only the new account got user %q, want %q", got, userId)
+  }
+
+  preferences, err := getUserPreferences(userId)
+  if err != nil {
+    t.Fatalf("getUserPreferences failed: %v", err)
+  }
+  if len(preferences.Watchlist) != 1 || preferences.Watchlist[0] != "F" {
+    t.Errorf("Watchlist = %v, want [F]", preferences.Watchlist)
+  }
+
+  if got := login("444"); got == userId {
+    t.Errorf("Login with unrelated accounts got the same user %q", got)
+  }
+}
@@ -0,0 +1,91 @@
+package pricing
+
+import (
+  "math"
+)
+
+// Returns the price of |c| with a Cox-Ross-Rubinstein tree of |steps| steps,
+// along with the tree's first two layers (used for the greeks).
+func binomialTree(c Contract, volatility float64, steps int) (float64, [2]float64, [3]float64) {
+  dt := c.Years / float64(steps)
+  up := math.Exp(volatility * math.Sqrt(dt))
+  down := 1 / up
+  growth := math.Exp((c.Rate - c.DividendYield) * dt)
+  probUp := (growth - down) / (up - down)
+  discount := math.Exp(-c.Rate * dt)
+
+  payoff := func(spot float64) float64 {
+    if c.Right == Call {
+      return math.Max(spot - c.Strike, 0)
+    }
+    return math.Max(c.Strike - spot, 0)
+  }
+
+  // values[i] is the value at the node with i up moves.
+  values := make([]float64, steps + 1)
+  for i := 0; i <= steps; i++ {
+    values[i] = payoff(c.Spot * math.Pow(up, float64(2 * i - steps)))
+  }
+
+  var layer1 [2]float64
+  var layer2 [3]float64
+  for step := steps - 1; step >= 0; step-- {
+    for i := 0; i <= step; i++ {
+      values[i] = discount * (probUp * values[i + 1] + (1 - probUp) * values[i])
+      if c.Style == American {
+        values[i] = math.Max(values[i], payoff(c.Spot * math.Pow(up, float64(2 * i - step))))
+      }
+    }
+    if step == 2 {
+      copy(layer2[:], values[:3])
+    }
+    if step == 1 {
+      copy(layer1[:], values[:2])
+    }
+  }
+  return values[0], layer1, layer2
+}
+
+// Prices |c| with a binomial tree of |steps| steps (at least 2).
+// This handles early exercise for American options.
+// |c| must be valid.
+func Binomial(c Contract, volatility float64, steps int) Result {
+  if steps < 2 {
+    steps = 2
+  }
+
+  price, layer1, layer2 := binomialTree(c, volatility, steps)
+  dt := c.Years / float64(steps)
+  up := math.Exp(volatility * math.Sqrt(dt))
+  down := 1 / up
+
+  // Delta and gamma come from the tree, the others from bumping the inputs.
+  result := Result{
+    Price: price,
+    Delta: (layer1[1] - layer1[0]) / (c.Spot * up - c.Spot * down),
+  }
+  upperSpot, middleSpot, lowerSpot := c.Spot * up * up, c.Spot, c.Spot * down * down
+  upperDelta := (layer2[2] - layer2[1]) / (upperSpot - middleSpot)
+  lowerDelta := (layer2[1] - layer2[0]) / (middleSpot - lowerSpot)
+  result.Gamma = (upperDelta - lowerDelta) / ((upperSpot - lowerSpot) / 2)
+  // The middle node of the second layer is the same spot, 2 steps later.
+  result.Theta = (layer2[1] - price) / (2 * dt) / 365
+
+  const volatilityBump = 0.01
+  bumped := c
+  // The volatility can't go below 0 so the bump down is smaller for low volatilities.
+  volatilityUp := volatility + volatilityBump
+  volatilityDown := math.Max(volatility - volatilityBump, volatilityBump / 10)
+  priceUp, _, _ := binomialTree(c, volatilityUp, steps)
+  priceDown, _, _ := binomialTree(c, volatilityDown, steps)
+  result.Vega = (priceUp - priceDown) / (100 * (volatilityUp - volatilityDown))
+
+  const rateBump = 0.0001
+  bumped.Rate = c.Rate + rateBump
+  priceUp, _, _ = binomialTree(bumped, volatility, steps)
+  bumped.Rate = c.Rate - rateBump
+  priceDown, _, _ = binomialTree(bumped, volatility, steps)
+  result.Rho = (priceUp - priceDown) / (2 * 100 * rateBump)
+
+  return result
+}
@@ -0,0 +1,32 @@
+package pricing
+
+import (
+  "math"
+)
+
+// Prices |c| as a European option with the Black-Scholes-Merton model.
+// |c| must be valid.
+func BlackScholes(c Contract, volatility float64) Result {
+  sqrtT := math.Sqrt(c.Years)
+  d1, d2 := c.d1d2(volatility)
+  discount := math.Exp(-c.Rate * c.Years)
+  dividendDiscount := math.Exp(-c.DividendYield * c.Years)
+
+  result := Result{
+    Gamma: dividendDiscount * normPDF(d1) / (c.Spot * volatility * sqrtT),
+    Vega: c.Spot * dividendDiscount * normPDF(d1) * sqrtT / 100,
+  }
+  decay := -c.Spot * dividendDiscount * normPDF(d1) * volatility / (2 * sqrtT)
+  if c.Right == Call {
+    result.Price = c.Spot * dividendDiscount * normCDF(d1) - c.Strike * discount * normCDF(d2)
+    result.Delta = dividendDiscount * normCDF(d1)
+    result.Theta = (decay - c.Rate * c.Strike * discount * normCDF(d2) + c.DividendYield * c.Spot * dividendDiscount * normCDF(d1)) / 365
+    result.Rho = c.Strike * c.Years * discount * normCDF(d2) / 100
+  } else {
+    result.Price = c.Strike * discount * normCDF(-d2) - c.Spot * dividendDiscount * normCDF(-d1)
+    result.Delta = dividendDiscount * (normCDF(d1) - 1)
+    result.Theta = (decay + c.Rate * c.Strike * discount * normCDF(-d2) - c.DividendYield * c.Spot * dividendDiscount * normCDF(-d1)) / 365
+    result.Rho = -c.Strike * c.Years * discount * normCDF(-d2) / 100
+  }
+  return result
+}
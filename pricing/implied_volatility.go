@@ -0,0 +1,51 @@
+package pricing
+
+import (
+  "errors"
+  "math"
+)
+
+// Bounds for the implied volatility search.
+const (
+  kMinImpliedVolatility float64 = 0.001
+  kMaxImpliedVolatility float64 = 5
+)
+
+var ErrNoImpliedVolatility = errors.New("No volatility matches the price")
+
+// Solves the volatility for which the price of |c| is |price|.
+//
+// Returns ErrNoImpliedVolatility if the price is outside of what the model
+// can produce for sensible volatilities (e.g. below the intrinsic value).
+//
+// Only the prices are computed while searching, call Price with the result
+// for the greeks.
+func ImpliedVolatility(c Contract, price float64) (float64, error) {
+  low, high := kMinImpliedVolatility, kMaxImpliedVolatility
+  lowPrice, err := priceOnly(c, low)
+  if err != nil {
+    return 0, err
+  }
+  highPrice, err := priceOnly(c, high)
+  if err != nil {
+    return 0, err
+  }
+  if price < lowPrice || price > highPrice {
+    return 0, ErrNoImpliedVolatility
+  }
+
+  // The price is increasing with the volatility so bisect.
+  for i := 0; i < 100 && high - low > 1e-5; i++ {
+    mid := (low + high) / 2
+    midPrice, _ := priceOnly(c, mid)
+    if math.Abs(midPrice - price) < 1e-6 {
+      return mid, nil
+    }
+    if midPrice < price {
+      low = mid
+    } else {
+      high = mid
+    }
+  }
+  return (low + high) / 2, nil
+}
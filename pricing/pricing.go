@@ -0,0 +1,116 @@
+// Package pricing computes theoretical prices, greeks and implied volatilities
+// for options.
+//
+// European options use the Black-Scholes model and American options a
+// Cox-Ross-Rubinstein binomial tree. The greeks follow the brokers'
+// conventions: theta is per calendar day, vega and rho are per 1% change.
+package pricing
+
+import (
+  "errors"
+  "math"
+)
+
+type Right int
+
+const (
+  Put Right = iota
+  Call
+)
+
+type Style int
+
+const (
+  European Style = iota
+  American
+)
+
+type Contract struct {
+  Right Right
+  Style Style
+
+  Spot float64
+  Strike float64
+  // Time to expiration in years.
+  Years float64
+  // The risk-free rate, e.g. 0.04 for 4%.
+  Rate float64
+  // The continuous dividend yield, e.g. 0.02 for 2%.
+  DividendYield float64
+}
+
+type Result struct {
+  Price float64
+  Delta float64
+  Gamma float64
+  Theta float64
+  Vega float64
+  Rho float64
+}
+
+// The number of steps used by Price for American options.
+const kDefaultBinomialSteps = 200
+
+var ErrInvalidContract = errors.New("Invalid contract")
+
+func (c Contract) validate(volatility float64) error {
+  if c.Spot <= 0 || c.Strike <= 0 || c.Years <= 0 || volatility <= 0 {
+    return ErrInvalidContract
+  }
+  return nil
+}
+
+// Returns the theoretical price and greeks of |c| for |volatility|
+// (annualized, e.g. 0.3 for 30%).
+func Price(c Contract, volatility float64) (Result, error) {
+  if err := c.validate(volatility); err != nil {
+    return Result{}, err
+  }
+
+  if c.Style == American {
+    return Binomial(c, volatility, kDefaultBinomialSteps), nil
+  }
+  return BlackScholes(c, volatility), nil
+}
+
+// Same as Price without the greeks. For American options, this only builds
+// one tree where Price builds five.
+func priceOnly(c Contract, volatility float64) (float64, error) {
+  if err := c.validate(volatility); err != nil {
+    return 0, err
+  }
+
+  if c.Style == American {
+    price, _, _ := binomialTree(c, volatility, kDefaultBinomialSteps)
+    return price, nil
+  }
+  return BlackScholes(c, volatility).Price, nil
+}
+
+func normCDF(x float64) float64 {
+  return 0.5 * math.Erfc(-x / math.Sqrt2)
+}
+
+func normPDF(x float64) float64 {
+  return math.Exp(-x * x / 2) / math.Sqrt(2 * math.Pi)
+}
+
+func (c Contract) d1d2(volatility float64) (float64, float64) {
+  sqrtT := math.Sqrt(c.Years)
+  d1 := (math.Log(c.Spot / c.Strike) + (c.Rate - c.DividendYield + volatility * volatility / 2) * c.Years) / (volatility * sqrtT)
+  return d1, d1 - volatility * sqrtT
+}
+
+// Returns the risk-neutral probability of |c| expiring in-the-money.
+// For a short option, this is the probability of being assigned at expiration.
+func ProbabilityITM(c Contract, volatility float64) (float64, error) {
+  if err := c.validate(volatility); err != nil {
+    return 0, err
+  }
+
+  _, d2 := c.d1d2(volatility)
+  if c.Right == Call {
+    return normCDF(d2), nil
+  }
+  return normCDF(-d2), nil
+}
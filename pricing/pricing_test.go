@@ -0,0 +1,131 @@
+package pricing
+
+import (
+  "math"
+  "testing"
+)
+
+func assertClose(t *testing.T, name string, got, want, tolerance float64) {
+  t.Helper()
+  if math.Abs(got - want) > tolerance {
+    t.Errorf("%s = %.4f, want %.4f (+/- %v)", name, got, want, tolerance)
+  }
+}
+
+// Hull, Options, Futures and Other Derivatives, example 15.6.
+var kHullContract = Contract{
+  Spot: 42,
+  Strike: 40,
+  Years: 0.5,
+  Rate: 0.10,
+}
+
+const kHullVolatility float64 = 0.20
+
+func TestBlackScholesReferenceValues(t *testing.T) {
+  tests := []struct {
+    right Right
+    price float64
+  }{
+    {Call, 4.7594},
+    {Put, 0.8086},
+  }
+  for _, test := range tests {
+    c := kHullContract
+    c.Right = test.right
+    result := BlackScholes(c, kHullVolatility)
+    assertClose(t, "Price", result.Price, test.price, 1e-4)
+  }
+}
+
+func TestPutCallParity(t *testing.T) {
+  contracts := []Contract{
+    kHullContract,
+    {Spot: 100, Strike: 110, Years: 1, Rate: 0.04, DividendYield: 0.02},
+    {Spot: 30, Strike: 25, Years: 30.0 / 365, Rate: 0.05},
+  }
+  for _, c := range contracts {
+    call, put := c, c
+    call.Right = Call
+    put.Right = Put
+    callPrice := BlackScholes(call, 0.3).Price
+    putPrice := BlackScholes(put, 0.3).Price
+
+    // C - P = S * e^(-qT) - K * e^(-rT).
+    parity := c.Spot * math.Exp(-c.DividendYield * c.Years) - c.Strike * math.Exp(-c.Rate * c.Years)
+    assertClose(t, "C - P", callPrice - putPrice, parity, 1e-9)
+  }
+}
+
+func TestBinomialAmericanPut(t *testing.T) {
+  // Hull, example 21.1: converges to 4.28 as the steps increase.
+  c := Contract{
+    Right: Put,
+    Style: American,
+    Spot: 50,
+    Strike: 50,
+    Years: 5.0 / 12,
+    Rate: 0.10,
+  }
+  result := Binomial(c, 0.40, 500)
+  assertClose(t, "Price", result.Price, 4.28, 0.01)
+
+  // Early exercise is worth something for a put.
+  c.Style = European
+  if european := BlackScholes(c, 0.40).Price; result.Price <= european {
+    t.Errorf("American put %.4f isn't above the European put %.4f", result.Price, european)
+  }
+}
+
+func TestBinomialConvergesToBlackScholes(t *testing.T) {
+  for _, right := range []Right{Call, Put} {
+    c := kHullContract
+    c.Right = right
+    expected := BlackScholes(c, kHullVolatility)
+    result := Binomial(c, kHullVolatility, 1000)
+    assertClose(t, "Price", result.Price, expected.Price, 0.01)
+    assertClose(t, "Delta", result.Delta, expected.Delta, 0.01)
+    assertClose(t, "Gamma", result.Gamma, expected.Gamma, 0.01)
+    assertClose(t, "Vega", result.Vega, expected.Vega, 0.01)
+  }
+}
+
+func TestBinomialVegaLowVolatility(t *testing.T) {
+  // The bump down is clamped below 1% of volatility. At the money without
+  // rates, the price is almost linear in the volatility so the finite
+  // difference matches the analytical vega.
+  c := Contract{Right: Call, Spot: 100, Strike: 100, Years: 1}
+  volatility := 0.005
+  expected := BlackScholes(c, volatility)
+  result := Binomial(c, volatility, 1000)
+  assertClose(t, "Vega", result.Vega, expected.Vega, 0.01)
+}
+
+func TestImpliedVolatilityRoundTrip(t *testing.T) {
+  contracts := []Contract{
+    kHullContract,
+    {Right: Put, Spot: 42, Strike: 40, Years: 0.5, Rate: 0.10},
+    {Right: Put, Style: American, Spot: 50, Strike: 50, Years: 5.0 / 12, Rate: 0.10},
+  }
+  for _, c := range contracts {
+    for _, volatility := range []float64{0.1, 0.25, 0.8} {
+      result, err := Price(c, volatility)
+      if err != nil {
+        t.Fatalf("Price failed: %v", err)
+      }
+      implied, err := ImpliedVolatility(c, result.Price)
+      if err != nil {
+        t.Fatalf("ImpliedVolatility failed: %v", err)
+      }
+      assertClose(t, "ImpliedVolatility", implied, volatility, 1e-3)
+    }
+  }
+}
+
+func TestImpliedVolatilityBelowIntrinsic(t *testing.T) {
+  c := kHullContract
+  c.Right = Call
+  if _, err := ImpliedVolatility(c, 1); err != ErrNoImpliedVolatility {
+    t.Errorf("ImpliedVolatility = %v, want ErrNoImpliedVolatility", err)
+  }
+}
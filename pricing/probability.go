@@ -0,0 +1,46 @@
+package pricing
+
+import (
+  "math"
+)
+
+// The probabilities below are risk-neutral: the underlying follows a geometric
+// Brownian motion drifting at the risk-free rate minus the dividend yield.
+
+// Returns the probability of the underlying touching the strike of |c| at any
+// time before expiration. This is 1 if |c| is already in-the-money.
+func ProbabilityOfTouch(c Contract, volatility float64) (float64, error) {
+  if err := c.validate(volatility); err != nil {
+    return 0, err
+  }
+
+  if (c.Right == Put && c.Spot <= c.Strike) || (c.Right == Call && c.Spot >= c.Strike) {
+    return 1, nil
+  }
+
+  // Reflection principle for a drifted Brownian motion in log space.
+  drift := c.Rate - c.DividendYield - volatility * volatility / 2
+  barrier := math.Log(c.Strike / c.Spot)
+  stdDev := volatility * math.Sqrt(c.Years)
+  reflection := math.Exp(2 * drift * barrier / (volatility * volatility))
+  if c.Right == Put {
+    // The barrier is below the spot.
+    return normCDF((barrier - drift * c.Years) / stdDev) + reflection * normCDF((barrier + drift * c.Years) / stdDev), nil
+  }
+  return normCDF((-barrier + drift * c.Years) / stdDev) + reflection * normCDF((-barrier - drift * c.Years) / stdDev), nil
+}
+
+// Returns the expected payoff of |c| at expiration (not discounted), assuming
+// it is held until then.
+//
+// The underlying drifts at |c|'s Rate: pass a real-world expected return
+// instead of the risk-free rate for a real-world expectation.
+func ExpectedPayoff(c Contract, volatility float64) (float64, error) {
+  if err := c.validate(volatility); err != nil {
+    return 0, err
+  }
+
+  european := c
+  european.Style = European
+  return BlackScholes(european, volatility).Price * math.Exp(c.Rate * c.Years), nil
+}
@@ -1,13 +1,24 @@
 package main
 
 import (
-  "encoding/json"
-  "fmt"
-  "io/ioutil"
-  "log"
-  "net/http"
+  "errors"
+  "regexp"
+  "strings"
 )
 
+// Returned by Broker.GetQuote when the broker doesn't know about the symbol.
+var errUnknownSymbol = errors.New("Unknown symbol")
+
+// Tickers are 1 to 5 letters, optionally followed by a share class (e.g. BRK.B).
+var kSymbolRegexp = regexp.MustCompile(`^[A-Z]{1,5}([./][A-Z]{1,2})?$`)
+
+// Normalizes |symbol| and validates its format.
+// Returns false if |symbol| is not a valid ticker.
+func normalizeSymbol(symbol string) (string, bool) {
+  symbol = strings.ToUpper(strings.TrimSpace(symbol))
+  return symbol, kSymbolRegexp.MatchString(symbol)
+}
+
 type Quote struct {
   Symbol string `json:"symbol"`
   LastPrice float64 `json:"lastPrice"`
@@ -21,30 +32,3 @@ type Quote struct {
   // HighPrice float64 `json:"highPrice"`
   // LowPrice float64 `json:"lowPrice"`
 }
-
-type tdaQuoteResponse map[string] Quote
-
-func GetQuote(symbol, apiKey string) (*Quote, error) {
-  url := fmt.Sprintf("https://api.tdameritrade.com/v1/marketdata/%s/quotes?apikey=%s", symbol, apiKey)
-  resp, err := http.Get(url)
-  if err != nil {
-    return nil, err
-  }
-
-  defer resp.Body.Close()
-  body, err := ioutil.ReadAll(resp.Body)
-  log.Printf("[INFO] Got response from %s", body)
-
-  var quote_resp tdaQuoteResponse
-  err = json.Unmarshal(body, &quote_resp)
-  if err != nil {
-    return nil, err
-  }
-
-  quote, exists := quote_resp[symbol]
-  if !exists {
-    panic("Invalid payload from server")
-  }
-
-  return &quote, nil
-}
@@ -0,0 +1,104 @@
+package main
+
+import (
+  "fmt"
+  "math"
+  "net/url"
+  "strconv"
+)
+
+// A Ranker decides which options are the best suggestions.
+type Ranker interface {
+  // Returns the score of |option|, higher is better.
+  Score(option Option) float64
+}
+
+// Returns the number of days |option| is held for, at least 1.
+// The options expiring today would otherwise have infinite scores, which
+// break the ordering of the suggestions.
+func daysHeld(option Option) float64 {
+  if option.DaysToExpiration < 1 {
+    return 1
+  }
+  return float64(option.DaysToExpiration)
+}
+
+// The premium collected per day, regardless of the capital at risk.
+type premiumPerDayRanker struct{}
+
+func (premiumPerDayRanker) Score(option Option) float64 {
+  return option.Mark / daysHeld(option)
+}
+
+// The premium as a return on the collateral (the strike), annualized.
+type annualizedReturnRanker struct{}
+
+func annualizedReturn(option Option) float64 {
+  return (option.Mark * option.Multiplier) / (option.StrikePrice * option.Multiplier) * 365 / daysHeld(option)
+}
+
+func (annualizedReturnRanker) Score(option Option) float64 {
+  return annualizedReturn(option)
+}
+
+// The annualized return weighted by the probability of the option expiring
+// worthless, estimated from the delta.
+type probabilityWeightedRanker struct{}
+
+func (probabilityWeightedRanker) Score(option Option) float64 {
+  return annualizedReturn(option) * (1 - math.Abs(option.Delta))
+}
+
+// How far out-of-the-money the strike is, relative to the spot.
+// This favors the safest strikes.
+type distanceFromSpotRanker struct{}
+
+func (distanceFromSpotRanker) Score(option Option) float64 {
+  distance := (option.UnderlyingPrice - option.StrikePrice) / option.UnderlyingPrice
+  if option.PutCall == CALL {
+    return -distance
+  }
+  return distance
+}
+
+// Values for the |rank| parameter.
+var kRankers = map[string]Ranker{
+  "premium_per_day": premiumPerDayRanker{},
+  "annualized_return": annualizedReturnRanker{},
+  "probability_weighted": probabilityWeightedRanker{},
+  "distance_from_spot": distanceFromSpotRanker{},
+}
+
+const kDefaultRanker string = "premium_per_day"
+
+const (
+  kDefaultSuggestionCount = 3
+  kMaxSuggestionCount = 50
+)
+
+// Parses the |rank| and |count| parameters.
+// |defaultRank| is used if there is no |rank|, kDefaultRanker if it is empty too.
+func parseRankingParams(query url.Values, defaultRank string) (Ranker, int, error) {
+  rankName := query.Get("rank")
+  if rankName == "" {
+    rankName = defaultRank
+  }
+  if rankName == "" {
+    rankName = kDefaultRanker
+  }
+  ranker, exists := kRankers[rankName]
+  if !exists {
+    return nil, 0, fmt.Errorf("Unknown rank: %s", rankName)
+  }
+
+  count := kDefaultSuggestionCount
+  if countParam := query.Get("count"); countParam != "" {
+    var err error
+    count, err = strconv.Atoi(countParam)
+    if err != nil || count <= 0 || count > kMaxSuggestionCount {
+      return nil, 0, fmt.Errorf("Invalid count: %s", countParam)
+    }
+  }
+
+  return ranker, count, nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+  "math"
+  "testing"
+)
+
+func TestRankersExpiringToday(t *testing.T) {
+  option := Option{
+    PutCall: PUT,
+    UnderlyingPrice: 33.2,
+    StrikePrice: 31,
+    Mark: 0.4,
+    Multiplier: 100,
+    Delta: -0.2,
+    DaysToExpiration: 0,
+  }
+  for name, ranker := range kRankers {
+    if score := ranker.Score(option); math.IsInf(score, 0) || math.IsNaN(score) {
+      t.Errorf("%s scored %v for an option expiring today", name, score)
+    }
+  }
+
+  // Same as holding it for a day.
+  option.DaysToExpiration = 1
+  expected := premiumPerDayRanker{}.Score(option)
+  option.DaysToExpiration = 0
+  if score := (premiumPerDayRanker{}).Score(option); score != expected {
+    t.Errorf("premium_per_day = %v, want %v", score, expected)
+  }
+}
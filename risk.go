@@ -0,0 +1,84 @@
+package main
+
+import (
+  "math"
+
+  "github.com/jchaffraix/WheelStrategy/pricing"
+)
+
+// The risk of selling an option, assuming it is held until expiration.
+type RiskMetrics struct {
+  // The probability of the option expiring worthless.
+  ProbabilityOTM float64 `json:"probabilityOTM"`
+  // The probability of the underlying reaching the strike before expiration.
+  ProbabilityOfTouch float64 `json:"probabilityOfTouch"`
+  // The probability of the underlying finishing past the breakeven.
+  ProbabilityOfProfit float64 `json:"probabilityOfProfit"`
+  // The underlying's price at which selling the option breaks even.
+  Breakeven float64 `json:"breakeven"`
+  // The expected profit for one contract, in today's dollars, if the
+  // underlying drifts at the expected return (see AppSettings.ExpectedReturn)
+  // with the implied volatility.
+  //
+  // This is only as good as the expected return: with the risk-free rate as
+  // the drift, the premium is the discounted expected payoff and this would
+  // be 0 (up to the early exercise premium) by construction.
+  ExpectedValue float64 `json:"expectedValue"`
+}
+
+// Computes the risk of selling |option| from its implied volatility.
+// |expectedReturn| is the underlying's real-world drift, see RiskMetrics.ExpectedValue.
+// Returns nil if we don't have a volatility to work with.
+func computeRiskMetrics(option Option, rate, expectedReturn float64) *RiskMetrics {
+  if option.ImpliedVolatility <= 0 {
+    return nil
+  }
+
+  contract := pricingContract(&option, rate)
+  probabilityITM, err := pricing.ProbabilityITM(contract, option.ImpliedVolatility)
+  if err != nil {
+    return nil
+  }
+  probabilityOfTouch, err := pricing.ProbabilityOfTouch(contract, option.ImpliedVolatility)
+  if err != nil {
+    return nil
+  }
+  realWorldContract := contract
+  realWorldContract.Rate = expectedReturn
+  expectedPayoff, err := pricing.ExpectedPayoff(realWorldContract, option.ImpliedVolatility)
+  if err != nil {
+    return nil
+  }
+  // The premium is collected now and the payoff paid at expiration.
+  discountedPayoff := expectedPayoff * math.Exp(-rate * contract.Years)
+
+  // The seller loses money once the option is in-the-money by more than the premium.
+  breakevenContract := contract
+  if option.PutCall == CALL {
+    breakevenContract.Strike = option.StrikePrice + option.Mark
+  } else {
+    breakevenContract.Strike = option.StrikePrice - option.Mark
+  }
+  probabilityOfLoss := 1.0
+  if breakevenContract.Strike > 0 {
+    probabilityOfLoss, err = pricing.ProbabilityITM(breakevenContract, option.ImpliedVolatility)
+    if err != nil {
+      return nil
+    }
+  }
+
+  return &RiskMetrics{
+    ProbabilityOTM: 1 - probabilityITM,
+    ProbabilityOfTouch: probabilityOfTouch,
+    ProbabilityOfProfit: 1 - probabilityOfLoss,
+    Breakeven: breakevenContract.Strike,
+    ExpectedValue: (option.Mark - discountedPayoff) * option.Multiplier,
+  }
+}
+
+// Sets the Risk of all |options|.
+func setRiskMetrics(options []Option, rate, expectedReturn float64) {
+  for i := range options {
+    options[i].Risk = computeRiskMetrics(options[i], rate, expectedReturn)
+  }
+}
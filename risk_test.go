@@ -0,0 +1,39 @@
+package main
+
+import (
+  "math"
+  "testing"
+)
+
+func TestExpectedValueDependsOnTheDrift(t *testing.T) {
+  option := Option{
+    PutCall: PUT,
+    UnderlyingPrice: 33.2,
+    StrikePrice: 31,
+    Mark: 0.4,
+    Multiplier: 100,
+    DaysToExpiration: 30,
+    // Solved from the Mark.
+    ImpliedVolatility: math.NaN(),
+  }
+  priceOption(&option, kDefaultRiskFreeRate)
+
+  // The Mark is priced at the risk-free rate so there is no edge.
+  neutral := computeRiskMetrics(option, kDefaultRiskFreeRate, kDefaultRiskFreeRate)
+  if neutral == nil {
+    t.Fatalf("No risk metrics")
+  }
+  if math.Abs(neutral.ExpectedValue) > 1 {
+    t.Errorf("ExpectedValue = %.2f at the risk-free drift, want about 0", neutral.ExpectedValue)
+  }
+
+  // A put seller profits from the underlying drifting up.
+  bullish := computeRiskMetrics(option, kDefaultRiskFreeRate, 0.2)
+  if bullish.ExpectedValue <= neutral.ExpectedValue + 1 {
+    t.Errorf("ExpectedValue = %.2f with a 20%% drift, want well above %.2f", bullish.ExpectedValue, neutral.ExpectedValue)
+  }
+  bearish := computeRiskMetrics(option, kDefaultRiskFreeRate, -0.2)
+  if bearish.ExpectedValue >= neutral.ExpectedValue {
+    t.Errorf("ExpectedValue = %.2f with a -20%% drift, want below %.2f", bearish.ExpectedValue, neutral.ExpectedValue)
+  }
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+  "fmt"
+  "log"
+  "net/http"
+  "sort"
+  "strconv"
+)
+
+// Rolling a short put buys it back and sells a later expiration (at the same
+// or a lower strike) for a net credit. This is how we avoid an assignment when
+// the put is tested or collect more premium when it's about to expire.
+
+// We look at the puts expiring within that many days by default.
+const kDefaultRollWithinDays = 7
+
+// Values for rollSuggestions.Reasons.
+const (
+  kRollInTheMoney = "IN_THE_MONEY"
+  kRollExpiring = "EXPIRING"
+)
+
+type rollCandidate struct {
+  // The put to sell.
+  Option Option `json:"option"`
+  // Per share, at the natural prices: the candidate's bid minus the current
+  // put's ask.
+  NetCredit float64 `json:"netCredit"`
+  DaysToExpiration int `json:"daysToExpiration"`
+  // The new strike minus all the premium collected: the original sale and the roll.
+  Breakeven float64 `json:"breakeven"`
+}
+
+type rollSuggestions struct {
+  Position Position `json:"position"`
+  Quote *Quote `json:"quote,omitempty"`
+  // The put we would buy back.
+  Current *Option `json:"current,omitempty"`
+  Reasons []string `json:"reasons"`
+  // Sorted by net credit per additional day.
+  Candidates []rollCandidate `json:"candidates"`
+  // Set if we failed to get the candidates for this position.
+  Error string `json:"error,omitempty"`
+}
+
+type rollsHandlerResponse struct {
+  Positions []rollSuggestions `json:"positions"`
+}
+
+// Returns why the short put described by |details| needs rolling, if it does.
+func rollReasons(details *OptionDetails, daysToExpiration int, quote *Quote, withinDays int) []string {
+  reasons := []string{}
+  if quote.LastPrice < details.StrikePrice {
+    reasons = append(reasons, kRollInTheMoney)
+  }
+  if daysToExpiration <= withinDays {
+    reasons = append(reasons, kRollExpiring)
+  }
+  return reasons
+}
+
+// Returns the roll candidates for |current| among |options|.
+//
+// The candidates expire later, at the same or a lower strike, for a net
+// credit. They also have to be in the days to expiration window of |chainParams|.
+func findRollCandidates(position Position, current *Option, options []Option, chainParams *ChainParams, count int) []rollCandidate {
+  candidates := []rollCandidate{}
+  for _, option := range options {
+    if option.DaysToExpiration <= current.DaysToExpiration ||
+       option.DaysToExpiration < chainParams.MinDaysToExpiration ||
+       option.DaysToExpiration > chainParams.MaxDaysToExpiration ||
+       !chainParams.matchesExpiration(option) ||
+       option.StrikePrice > current.StrikePrice {
+      continue
+    }
+
+    netCredit := roundToCents(option.Bid - current.Ask)
+    if netCredit <= 0 {
+      continue
+    }
+    candidates = append(candidates, rollCandidate{
+      Option: option,
+      NetCredit: netCredit,
+      DaysToExpiration: option.DaysToExpiration,
+      Breakeven: option.StrikePrice - position.AveragePrice - netCredit,
+    })
+  }
+
+  creditPerDay := func(candidate rollCandidate) float64 {
+    return candidate.NetCredit / float64(candidate.DaysToExpiration - current.DaysToExpiration)
+  }
+  sort.SliceStable(candidates, func(i, j int) bool {
+    return creditPerDay(candidates[i]) > creditPerDay(candidates[j])
+  })
+  if len(candidates) > count {
+    candidates = candidates[:count]
+  }
+  return candidates
+}
+
+// Returns the roll suggestions for the short put |position|.
+// Returns nil if it doesn't need rolling.
+func suggestRolls(broker Broker, position Position, chainParams *ChainParams, withinDays, count int, riskFreeRate float64) *rollSuggestions {
+  details := position.Option
+  suggestions := &rollSuggestions{
+    Position: position,
+    Reasons: []string{},
+    Candidates: []rollCandidate{},
+  }
+
+  daysToExpiration, err := details.daysToExpiration()
+  if err != nil || daysToExpiration < 0 {
+    suggestions.Error = "The put has expired"
+    return suggestions
+  }
+
+  quote, err := broker.GetQuote(details.Underlying)
+  if err != nil {
+    log.Printf("[ERROR] Failed to get the quote for %s (err = %+v)", details.Underlying, err)
+    suggestions.Error = "Failed to get the quote"
+    return suggestions
+  }
+  suggestions.Quote = quote
+  suggestions.Reasons = rollReasons(details, daysToExpiration, quote, withinDays)
+  if len(suggestions.Reasons) == 0 {
+    return nil
+  }
+
+  // The strikes we roll to can be far from the spot, so we need them all.
+  // The expirations are filtered by findRollCandidates as we need the current one.
+  rollChainParams := &ChainParams{
+    MinDaysToExpiration: daysToExpiration - 1,
+    MaxDaysToExpiration: chainParams.MaxDaysToExpiration,
+    Range: "ALL",
+    Expirations: kAllExpirations,
+  }
+  if rollChainParams.MinDaysToExpiration < 0 {
+    rollChainParams.MinDaysToExpiration = 0
+  }
+  if rollChainParams.MaxDaysToExpiration < daysToExpiration {
+    rollChainParams.MaxDaysToExpiration = daysToExpiration + 1
+  }
+  _, options, err := getSymbolChain(broker, details.Underlying, PUT, rollChainParams)
+  if err != nil {
+    log.Printf("[ERROR] Failed to get options for symbol %s (err = %+v)", details.Underlying, err)
+    suggestions.Error = "Failed to get the options"
+    return suggestions
+  }
+
+  for i := range options {
+    if options[i].Symbol == position.Symbol {
+      suggestions.Current = &options[i]
+      break
+    }
+  }
+  if suggestions.Current == nil {
+    suggestions.Error = "The put is not in the option chain"
+    return suggestions
+  }
+
+  suggestions.Candidates = findRollCandidates(position, suggestions.Current, options, chainParams, count)
+  // Only price what we return, the chain has all the strikes.
+  priceOption(suggestions.Current, riskFreeRate)
+  for i := range suggestions.Candidates {
+    priceOption(&suggestions.Candidates[i].Option, riskFreeRate)
+  }
+  return suggestions
+}
+
+// Suggests rolls for the short puts of the logged in user that are in the
+// money or expiring within |within_days| days.
+//
+// The candidates are in the days to expiration window of the chain
+// parameters and |count| caps their number per put.
+func rollsHandler(w http.ResponseWriter, req *http.Request) {
+  logRequest(req)
+
+  session, accountId := getRequestAccount(w, req)
+  if session == nil {
+    return
+  }
+
+  chainParams, err := getRequestChainParams(req, getSessionPreferences(session))
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusBadRequest)
+    return
+  }
+
+  query := req.URL.Query()
+  withinDays := kDefaultRollWithinDays
+  if param := query.Get("within_days"); param != "" {
+    withinDays, err = strconv.Atoi(param)
+    if err != nil || withinDays < 0 {
+      http.Error(w, fmt.Sprintf("Invalid within_days: %s", param), http.StatusBadRequest)
+      return
+    }
+  }
+  count := kDefaultSuggestionCount
+  if param := query.Get("count"); param != "" {
+    count, err = strconv.Atoi(param)
+    if err != nil || count <= 0 || count > kMaxSuggestionCount {
+      http.Error(w, fmt.Sprintf("Invalid count: %s", param), http.StatusBadRequest)
+      return
+    }
+  }
+
+  settings, err := getAppSettings()
+  if err != nil {
+    log.Printf("[ERROR] Failed getting the app settings (err = %+v)", err)
+    http.Error(w, "Internal Error", http.StatusInternalServerError)
+    return
+  }
+
+  broker := getBroker(settings, session)
+  userAccountInfo, err := broker.GetUserAccountInfo(accountId)
+  if err != nil {
+    writeBrokerError(w, err, "get user account info")
+    return
+  }
+
+  resp := rollsHandlerResponse{
+    Positions: []rollSuggestions{},
+  }
+  for _, position := range userAccountInfo.OptionPositions() {
+    if position.Option.PutCall != PUT || position.Quantity >= 0 {
+      continue
+    }
+
+    suggestions := suggestRolls(broker, position, chainParams, withinDays, count, settings.riskFreeRate())
+    if suggestions != nil {
+      resp.Positions = append(resp.Positions, *suggestions)
+    }
+  }
+
+  writeJSON(w, resp)
+}
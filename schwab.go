@@ -0,0 +1,324 @@
+package main
+
+import (
+  "encoding/json"
+  "errors"
+  "fmt"
+  "log"
+  "net/http"
+  "net/url"
+  "strconv"
+  "time"
+
+  "golang.org/x/oauth2"
+)
+
+const kSchwabBaseURL string = "https://api.schwabapi.com"
+
+// Broker implementation for the Schwab Trader API.
+//
+// Unlike TDA, all the calls (including market data) require a logged in user.
+// The option chains have the same format as TDA's so we share the parsing.
+type schwabBroker struct {
+  baseURL string
+  // Authenticated client, nil if the user is not logged in.
+  client *http.Client
+
+  // Schwab identifies the accounts by an opaque hash in the URLs.
+  // This is populated lazily from the account numbers.
+  accountHashes map[string]string
+}
+
+func newSchwabBroker(settings *AppSettings, client *http.Client) *schwabBroker {
+  return &schwabBroker{
+    baseURL: settingOrDefault(settings.APIBaseURL, kSchwabBaseURL),
+    client: client,
+  }
+}
+
+func schwabOAuthConfig(s *AppSettings) *oauth2.Config {
+  return &oauth2.Config{
+    ClientID: s.SchwabClientId,
+    ClientSecret: s.SchwabClientSecret,
+    // Schwab only has the "api" scope: what the app can do (market data,
+    // trading) comes from the products it subscribed to in the portal.
+    // We need trading to place and replace the orders.
+    Scopes: []string{"api"},
+    Endpoint: oauth2.Endpoint{
+      TokenURL: settingOrDefault(s.TokenURL, kSchwabBaseURL + "/v1/oauth/token"),
+      AuthURL: settingOrDefault(s.AuthURL, kSchwabBaseURL + "/v1/oauth/authorize"),
+      // Schwab requires the client credentials as basic auth.
+      AuthStyle: oauth2.AuthStyleInHeader,
+    },
+    RedirectURL: s.SchwabRedirectURL,
+  }
+}
+
+// Performs an authenticated GET to |path| and returns the body.
+// Non-2xx responses are returned as errors, see doAuthenticatedRequest.
+func (b *schwabBroker) get(path string) ([]byte, error) {
+  _, body, err := doAuthenticatedRequest(b.client, http.MethodGet, b.baseURL + path, nil)
+  return body, err
+}
+
+// Quotes
+
+type schwabQuoteReference struct {
+  Cusip string `json:"cusip"`
+  ExchangeName string `json:"exchangeName"`
+}
+
+type schwabQuoteData struct {
+  LastPrice float64 `json:"lastPrice"`
+  TotalVolume int `json:"totalVolume"`
+  FiftyTwoWeekHigh float64 `json:"52WeekHigh"`
+  FiftyTwoWeekLow float64 `json:"52WeekLow"`
+}
+
+type schwabQuote struct {
+  Symbol string `json:"symbol"`
+  Quote schwabQuoteData `json:"quote"`
+  Reference schwabQuoteReference `json:"reference"`
+}
+
+type schwabQuoteResponse map[string]schwabQuote
+
+func (b *schwabBroker) GetQuote(symbol string) (*Quote, error) {
+  body, err := b.get(fmt.Sprintf("/marketdata/v1/%s/quotes", url.PathEscape(symbol)))
+  if isNotFound(err) {
+    return nil, errUnknownSymbol
+  }
+  if err != nil {
+    return nil, err
+  }
+
+  var quote_resp schwabQuoteResponse
+  err = json.Unmarshal(body, &quote_resp)
+  if err != nil {
+    return nil, err
+  }
+
+  quote, exists := quote_resp[symbol]
+  if !exists {
+    return nil, errUnknownSymbol
+  }
+
+  return &Quote{
+    Symbol: quote.Symbol,
+    LastPrice: quote.Quote.LastPrice,
+    TotalVolume: quote.Quote.TotalVolume,
+    Exchange: quote.Reference.ExchangeName,
+    FiftyTwoWeekHigh: quote.Quote.FiftyTwoWeekHigh,
+    FiftyTwoWeekLow: quote.Quote.FiftyTwoWeekLow,
+    Cusip: quote.Reference.Cusip,
+  }, nil
+}
+
+// Option chains
+
+// Schwab's expirationType for the standard monthly expirations. The others
+// are "W" (weekly), "Q" (quarterly) and "M" (end of month).
+const kSchwabMonthlyExpirationType = "S"
+
+func (b *schwabBroker) GetOptionChain(symbol, putCall string, params *ChainParams) ([]Option, error) {
+  start, end := params.dateRange()
+  query := url.Values{}
+  query.Set("symbol", symbol)
+  query.Set("contractType", putCall)
+  if params.StrikeCount > 0 {
+    query.Set("strikeCount", strconv.Itoa(params.StrikeCount))
+  }
+  query.Set("range", params.Range)
+  query.Set("fromDate", start.Format("2006-01-02"))
+  query.Set("toDate", end.Format("2006-01-02"))
+  body, err := b.get("/marketdata/v1/chains?" + query.Encode())
+  if isNotFound(err) {
+    return []Option{}, errUnknownSymbol
+  }
+  if err != nil {
+    return []Option{}, err
+  }
+
+  var option_response tdaOptionChainResponse
+  err = json.Unmarshal(body, &option_response)
+  if err != nil {
+    return []Option{}, err
+  }
+
+  if option_response.Status != "SUCCESS" {
+    return []Option{}, errors.New("Called failed")
+  }
+
+  return formatResponse(option_response, putCall, kSchwabMonthlyExpirationType)
+}
+
+// Accounts
+
+type schwabAccountNumber struct {
+  AccountNumber string `json:"accountNumber"`
+  HashValue string `json:"hashValue"`
+}
+
+type schwabCurrentBalances struct {
+  CashAvailableForTrading float64 `json:"cashAvailableForTrading"`
+}
+
+type schwabSecuritiesAccount struct {
+  AccountNumber string `json:"accountNumber"`
+  CurrentBalances schwabCurrentBalances `json:"currentBalances"`
+  Positions []tdaPosition `json:"positions"`
+}
+
+type schwabAccountResponse struct {
+  SecuritiesAccount schwabSecuritiesAccount `json:"securitiesAccount"`
+}
+
+func (b *schwabBroker) getAccountNumbers() ([]schwabAccountNumber, error) {
+  body, err := b.get("/trader/v1/accounts/accountNumbers")
+  if err != nil {
+    return nil, err
+  }
+
+  var accountNumbers []schwabAccountNumber
+  err = json.Unmarshal(body, &accountNumbers)
+  if err != nil {
+    log.Printf("[ERROR] Failed to parse the account numbers response (err = %+v): %s", err, bodyForLog(body))
+    return nil, err
+  }
+
+  b.accountHashes = make(map[string]string, len(accountNumbers))
+  for _, accountNumber := range accountNumbers {
+    b.accountHashes[accountNumber.AccountNumber] = accountNumber.HashValue
+  }
+  return accountNumbers, nil
+}
+
+func (b *schwabBroker) getAccountHash(accountId string) (string, error) {
+  if b.accountHashes == nil {
+    if _, err := b.getAccountNumbers(); err != nil {
+      return "", err
+    }
+  }
+
+  hash, exists := b.accountHashes[accountId]
+  if !exists {
+    return "", fmt.Errorf("Unknown account %s", accountId)
+  }
+  return hash, nil
+}
+
+func (b *schwabBroker) GetAccountIds() ([]string, error) {
+  accountNumbers, err := b.getAccountNumbers()
+  if err != nil {
+    return nil, err
+  }
+
+  accountIds := make([]string, 0, len(accountNumbers))
+  for _, accountNumber := range accountNumbers {
+    accountIds = append(accountIds, accountNumber.AccountNumber)
+  }
+  return accountIds, nil
+}
+
+// Orders
+
+// Schwab wants the times with milliseconds: yyyy-MM-dd'T'HH:mm:ss.SSSZ.
+const kSchwabTimeFormat = "2006-01-02T15:04:05.000Z"
+
+func (b *schwabBroker) PlaceOrder(accountId string, order *Order) (string, error) {
+  ordersURL, err := b.ordersURL(accountId)
+  if err != nil {
+    return "", err
+  }
+
+  resp, _, err := doAuthenticatedRequest(b.client, http.MethodPost, ordersURL, newTDAOrder(order))
+  if err != nil {
+    return "", err
+  }
+  return orderIdFromLocation(resp)
+}
+
+func (b *schwabBroker) ordersURL(accountId string) (string, error) {
+  hash, err := b.getAccountHash(accountId)
+  if err != nil {
+    return "", err
+  }
+  return fmt.Sprintf("%s/trader/v1/accounts/%s/orders", b.baseURL, hash), nil
+}
+
+func (b *schwabBroker) GetOrders(accountId string) ([]Order, error) {
+  ordersURL, err := b.ordersURL(accountId)
+  if err != nil {
+    return nil, err
+  }
+
+  // Both ends of the time range are mandatory.
+  now := time.Now().UTC()
+  query := url.Values{}
+  query.Set("fromEnteredTime", now.AddDate(0, 0, -kOrdersLookbackDays).Format(kSchwabTimeFormat))
+  query.Set("toEnteredTime", now.Format(kSchwabTimeFormat))
+  _, body, err := doAuthenticatedRequest(b.client, http.MethodGet, ordersURL + "?" + query.Encode(), nil)
+  if err != nil {
+    return nil, err
+  }
+  return parseOrders(accountId, body)
+}
+
+func (b *schwabBroker) GetOrder(accountId, orderId string) (*Order, error) {
+  ordersURL, err := b.ordersURL(accountId)
+  if err != nil {
+    return nil, err
+  }
+
+  _, body, err := doAuthenticatedRequest(b.client, http.MethodGet, ordersURL + "/" + url.PathEscape(orderId), nil)
+  if err != nil {
+    return nil, err
+  }
+  return parseOrder(accountId, body)
+}
+
+func (b *schwabBroker) CancelOrder(accountId, orderId string) error {
+  ordersURL, err := b.ordersURL(accountId)
+  if err != nil {
+    return err
+  }
+
+  _, _, err = doAuthenticatedRequest(b.client, http.MethodDelete, ordersURL + "/" + url.PathEscape(orderId), nil)
+  return err
+}
+
+func (b *schwabBroker) ReplaceOrder(accountId, orderId string, order *Order) (string, error) {
+  ordersURL, err := b.ordersURL(accountId)
+  if err != nil {
+    return "", err
+  }
+
+  resp, _, err := doAuthenticatedRequest(b.client, http.MethodPut, ordersURL + "/" + url.PathEscape(orderId), newTDAOrder(order))
+  if err != nil {
+    return "", err
+  }
+  return orderIdFromLocation(resp)
+}
+
+func (b *schwabBroker) GetUserAccountInfo(accountId string) (*UserAccountInfo, error) {
+  hash, err := b.getAccountHash(accountId)
+  if err != nil {
+    return nil, err
+  }
+
+  body, err := b.get(fmt.Sprintf("/trader/v1/accounts/%s?fields=positions", hash))
+  if err != nil {
+    return nil, err
+  }
+
+  var accountResponse schwabAccountResponse
+  err = json.Unmarshal(body, &accountResponse)
+  if err != nil {
+    return nil, err
+  }
+
+  return &UserAccountInfo{
+    CashAvailableForTrading: accountResponse.SecuritiesAccount.CurrentBalances.CashAvailableForTrading,
+    Positions: formatPositions(accountResponse.SecuritiesAccount.Positions),
+  }, nil
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+  "encoding/json"
+  "io/ioutil"
+  "math"
+  "net/http"
+  "net/http/httptest"
+  "path/filepath"
+  "strings"
+  "testing"
+  "time"
+)
+
+// The account hash for "12345678" in testdata/schwab/accountNumbers.json.
+const kSchwabTestAccountHash = "E7A3F0D2B91C4A5E8F6D0B1C2A3E4F5A6B7C8D9E0F1A2B3C4D5E6F7A8B9C0D1E"
+
+// Serves the recorded Schwab responses in testdata/schwab and records the requests.
+type schwabTestServer struct {
+  *httptest.Server
+  t *testing.T
+  requests []*http.Request
+  bodies []string
+}
+
+func newSchwabTestServer(t *testing.T) *schwabTestServer {
+  s := &schwabTestServer{t: t}
+  s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+  t.Cleanup(s.Close)
+  return s
+}
+
+func (s *schwabTestServer) serveFixture(w http.ResponseWriter, name string) {
+  body, err := ioutil.ReadFile(filepath.Join("testdata", "schwab", name))
+  if err != nil {
+    s.t.Fatalf("Failed to read the fixture %s: %v", name, err)
+  }
+  w.Header().Set("Content-Type", "application/json")
+  w.Write(body)
+}
+
+func (s *schwabTestServer) handle(w http.ResponseWriter, req *http.Request) {
+  body, _ := ioutil.ReadAll(req.Body)
+  s.requests = append(s.requests, req)
+  s.bodies = append(s.bodies, string(body))
+
+  accountPath := "/trader/v1/accounts/" + kSchwabTestAccountHash
+  switch {
+  case req.URL.Path == "/marketdata/v1/WY/quotes":
+    s.serveFixture(w, "quotes.json")
+  case req.URL.Path == "/marketdata/v1/UNKNOWN/quotes":
+    w.Write([]byte("{}"))
+  case req.URL.Path == "/marketdata/v1/BUSY/quotes":
+    http.Error(w, "Try again later", http.StatusServiceUnavailable)
+  case req.URL.Path == "/marketdata/v1/chains":
+    s.serveFixture(w, "chains.json")
+  case req.URL.Path == "/trader/v1/accounts/accountNumbers":
+    s.serveFixture(w, "accountNumbers.json")
+  case req.URL.Path == accountPath:
+    s.serveFixture(w, "account.json")
+  case req.URL.Path == accountPath + "/orders" && req.Method == http.MethodGet:
+    s.serveFixture(w, "orders.json")
+  case req.URL.Path == accountPath + "/orders" && req.Method == http.MethodPost:
+    w.Header().Set("Location", s.URL + accountPath + "/orders/1000123458")
+    w.WriteHeader(http.StatusCreated)
+  case req.URL.Path == accountPath + "/orders/1000123456" && req.Method == http.MethodGet:
+    s.serveFixture(w, "order.json")
+  case req.URL.Path == accountPath + "/orders/1000123456" && req.Method == http.MethodPut:
+    w.Header().Set("Location", s.URL + accountPath + "/orders/1000123459")
+    w.WriteHeader(http.StatusCreated)
+  case req.URL.Path == accountPath + "/orders/1000123456" && req.Method == http.MethodDelete:
+    w.WriteHeader(http.StatusOK)
+  default:
+    http.NotFound(w, req)
+  }
+}
+
+func (s *schwabTestServer) lastRequest() *http.Request {
+  return s.requests[len(s.requests) - 1]
+}
+
+func (s *schwabTestServer) newBroker(client *http.Client) *schwabBroker {
+  return newSchwabBroker(&AppSettings{Broker: kBrokerSchwab, APIBaseURL: s.URL}, client)
+}
+
+func TestSchwabGetQuote(t *testing.T) {
+  server := newSchwabTestServer(t)
+  broker := server.newBroker(http.DefaultClient)
+
+  quote, err := broker.GetQuote("WY")
+  if err != nil {
+    t.Fatalf("GetQuote failed: %v", err)
+  }
+  expected := Quote{
+    Symbol: "WY",
+    LastPrice: 33.2,
+    TotalVolume: 3204512,
+    Exchange: "NYSE",
+    FiftyTwoWeekHigh: 36.27,
+    FiftyTwoWeekLow: 26.13,
+    Cusip: "962166104",
+  }
+  if *quote != expected {
+    t.Errorf("GetQuote = %+v, want %+v", *quote, expected)
+  }
+
+  if _, err := broker.GetQuote("UNKNOWN"); err != errUnknownSymbol {
+    t.Errorf("GetQuote(UNKNOWN) = %v, want errUnknownSymbol", err)
+  }
+  // Not served by the test server.
+  if _, err := broker.GetQuote("MISSING"); err != errUnknownSymbol {
+    t.Errorf("GetQuote(MISSING) = %v, want errUnknownSymbol", err)
+  }
+  if _, err := broker.GetQuote("BUSY"); !isTransient(err) {
+    t.Errorf("GetQuote(BUSY) = %v, want a transient error", err)
+  }
+}
+
+func TestSchwabGetOptionChain(t *testing.T) {
+  server := newSchwabTestServer(t)
+  broker := server.newBroker(http.DefaultClient)
+
+  params := defaultChainParams()
+  options, err := broker.GetOptionChain("WY", PUT, params)
+  if err != nil {
+    t.Fatalf("GetOptionChain failed: %v", err)
+  }
+
+  query := server.lastRequest().URL.Query()
+  start, end := params.dateRange()
+  expectedQuery := map[string]string{
+    "symbol": "WY",
+    "contractType": PUT,
+    "strikeCount": "5",
+    "range": "SBK",
+    "fromDate": start.Format("2006-01-02"),
+    "toDate": end.Format("2006-01-02"),
+  }
+  for name, value := range expectedQuery {
+    if query.Get(name) != value {
+      t.Errorf("Query parameter %s = %q, want %q", name, query.Get(name), value)
+    }
+  }
+
+  if len(options) != 2 {
+    t.Fatalf("Got %d options, want 2", len(options))
+  }
+  byStrike := map[float64]Option{}
+  for _, option := range options {
+    byStrike[option.StrikePrice] = option
+  }
+
+  option := byStrike[31]
+  if option.Symbol != "WY    240517P00031000" || option.PutCall != PUT || option.Expiration != "2024-05-17" {
+    t.Errorf("Unexpected option %+v", option)
+  }
+  if !option.MonthlyExpiration {
+    t.Errorf("Expected a monthly expiration from the expirationType")
+  }
+  if option.Mark != 0.4 || option.OpenInterest != 842 || option.Volume != 57 || option.DaysToExpiration != 30 || option.Multiplier != 100 {
+    t.Errorf("Unexpected quote fields %+v", option)
+  }
+  if option.Delta != -0.214 || math.Abs(option.ImpliedVolatility - 0.2742) > 1e-9 {
+    t.Errorf("Delta = %v, ImpliedVolatility = %v, want -0.214 and 0.2742", option.Delta, option.ImpliedVolatility)
+  }
+
+  // The "NaN" greeks are missing values.
+  option = byStrike[32]
+  if !isMissingValue(option.Delta) || !isMissingValue(option.ImpliedVolatility) {
+    t.Errorf("Delta = %v, ImpliedVolatility = %v, want missing values", option.Delta, option.ImpliedVolatility)
+  }
+}
+
+func TestSchwabAccounts(t *testing.T) {
+  server := newSchwabTestServer(t)
+  broker := server.newBroker(http.DefaultClient)
+
+  accountIds, err := broker.GetAccountIds()
+  if err != nil {
+    t.Fatalf("GetAccountIds failed: %v", err)
+  }
+  if strings.Join(accountIds, ",") != "12345678,87654321" {
+    t.Errorf("GetAccountIds = %v", accountIds)
+  }
+
+  info, err := broker.GetUserAccountInfo("12345678")
+  if err != nil {
+    t.Fatalf("GetUserAccountInfo failed: %v", err)
+  }
+  if query := server.lastRequest().URL.Query(); query.Get("fields") != "positions" {
+    t.Errorf("fields = %q, want positions", query.Get("fields"))
+  }
+  if info.CashAvailableForTrading != 23950.32 {
+    t.Errorf("CashAvailableForTrading = %v", info.CashAvailableForTrading)
+  }
+  if len(info.Positions) != 2 {
+    t.Fatalf("Got %d positions, want 2", len(info.Positions))
+  }
+  if position := info.Positions[0]; position.Symbol != "WY" || position.Quantity != 100 || position.Option != nil {
+    t.Errorf("Unexpected equity position %+v", position)
+  }
+  position := info.Positions[1]
+  expectedDetails := OptionDetails{Underlying: "F", PutCall: PUT, StrikePrice: 12, Expiration: "2024-05-17"}
+  if position.Quantity != -1 || position.Option == nil || *position.Option != expectedDetails {
+    t.Errorf("Unexpected option position %+v (details %+v)", position, position.Option)
+  }
+
+  if _, err := broker.GetUserAccountInfo("00000000"); err == nil {
+    t.Errorf("GetUserAccountInfo succeeded for an unknown account")
+  }
+}
+
+func TestSchwabOrders(t *testing.T) {
+  server := newSchwabTestServer(t)
+  broker := server.newBroker(http.DefaultClient)
+
+  orders, err := broker.GetOrders("12345678")
+  if err != nil {
+    t.Fatalf("GetOrders failed: %v", err)
+  }
+  query := server.lastRequest().URL.Query()
+  for _, name := range []string{"fromEnteredTime", "toEnteredTime"} {
+    if _, err := time.Parse(kSchwabTimeFormat, query.Get(name)); err != nil {
+      t.Errorf("%s = %q isn't in the Schwab format", name, query.Get(name))
+    }
+  }
+  // The multi-leg order is skipped.
+  if len(orders) != 1 {
+    t.Fatalf("Got %d orders, want 1", len(orders))
+  }
+  expected := Order{
+    OrderId: "1000123456",
+    AccountId: "12345678",
+    Instruction: kSellToOpen,
+    OptionSymbol: "WY    240517P00031000",
+    Contracts: 1,
+    LimitPrice: 0.45,
+    Duration: "DAY",
+    Status: kOrderWorking,
+    EnteredTime: "2024-04-17T14:31:02+0000",
+  }
+  if orders[0] != expected {
+    t.Errorf("GetOrders = %+v, want %+v", orders[0], expected)
+  }
+
+  order, err := broker.GetOrder("12345678", "1000123456")
+  if err != nil {
+    t.Fatalf("GetOrder failed: %v", err)
+  }
+  if order.Status != kOrderFilled || order.FilledContracts != 1 {
+    t.Errorf("GetOrder = %+v", *order)
+  }
+
+  newOrder := &Order{
+    Instruction: kSellToOpen,
+    OptionSymbol: "WY    240517P00031000",
+    Contracts: 1,
+    LimitPrice: 0.4,
+    Duration: "DAY",
+  }
+  orderId, err := broker.PlaceOrder("12345678", newOrder)
+  if err != nil {
+    t.Fatalf("PlaceOrder failed: %v", err)
+  }
+  if orderId != "1000123458" {
+    t.Errorf("PlaceOrder = %s, want 1000123458", orderId)
+  }
+  var sent tdaOrder
+  if err := json.Unmarshal([]byte(server.bodies[len(server.bodies) - 1]), &sent); err != nil {
+    t.Fatalf("Invalid order body: %v", err)
+  }
+  if sent.OrderType != "LIMIT" || sent.Price != 0.4 || len(sent.OrderLegCollection) != 1 || sent.OrderLegCollection[0].Instrument.Symbol != newOrder.OptionSymbol {
+    t.Errorf("Unexpected order sent %+v", sent)
+  }
+
+  orderId, err = broker.ReplaceOrder("12345678", "1000123456", newOrder)
+  if err != nil {
+    t.Fatalf("ReplaceOrder failed: %v", err)
+  }
+  if orderId != "1000123459" {
+    t.Errorf("ReplaceOrder = %s, want 1000123459", orderId)
+  }
+
+  if err := broker.CancelOrder("12345678", "1000123456"); err != nil {
+    t.Fatalf("CancelOrder failed: %v", err)
+  }
+  if method := server.lastRequest().Method; method != http.MethodDelete {
+    t.Errorf("CancelOrder sent a %s", method)
+  }
+
+  if err := broker.CancelOrder("12345678", "404"); !isNotFound(err) {
+    t.Errorf("CancelOrder(404) = %v, want a not found error", err)
+  }
+}
+
+func TestSchwabRequiresLogin(t *testing.T) {
+  server := newSchwabTestServer(t)
+  broker := server.newBroker(nil)
+
+  if _, err := broker.GetQuote("WY"); err != errNotLoggedIn {
+    t.Errorf("GetQuote = %v, want errNotLoggedIn", err)
+  }
+  if _, err := broker.GetAccountIds(); err != errNotLoggedIn {
+    t.Errorf("GetAccountIds = %v, want errNotLoggedIn", err)
+  }
+  if len(server.requests) != 0 {
+    t.Errorf("Sent %d requests without a user", len(server.requests))
+  }
+}
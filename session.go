@@ -0,0 +1,412 @@
+package main
+
+import (
+  "context"
+  "crypto/hmac"
+  "crypto/rand"
+  "crypto/sha256"
+  "encoding/base64"
+  "errors"
+  "fmt"
+  "log"
+  "net/http"
+  "strings"
+  "sync"
+  "time"
+
+  "golang.org/x/oauth2"
+
+  "cloud.google.com/go/datastore"
+)
+
+// The sessions of the logged in users are kept on the server. The LOGIN
+// cookie only holds an opaque session ID, signed with the session key so a
+// forged or tampered cookie is rejected before hitting the store. The cookie
+// is HttpOnly: the tokens never leave the server and the page has no use for
+// the ID.
+//
+// The session has the full OAuth token so we can refresh the access token
+// when it expires (after 30 minutes for TDA and Schwab) instead of logging
+// the user out.
+
+// How long a session lives, the LOGIN cookie expires at the same time.
+// The refresh tokens outlive it.
+const kSessionDuration = 7 * 24 * time.Hour
+
+// Returned by the SessionStore for unknown sessions.
+var errSessionNotFound = errors.New("Session not found")
+
+// Returned by getLoginSession when the LOGIN cookie's signature doesn't match.
+var errInvalidSessionCookie = errors.New("Invalid session cookie")
+
+// Returned by getLoginSession when the session is older than kSessionDuration.
+var errSessionExpired = errors.New("Session expired")
+
+type Session struct {
+  // The key in the store, not stored.
+  Id string `datastore:"-"`
+
+  // The selected account, see accounts.go.
+  AccountId string `datastore:",noindex"`
+  // All the accounts the user has access to.
+  AccountIds []string `datastore:",noindex"`
+  // The key of the User, see recordUserLogin.
+  UserId string `datastore:",noindex"`
+  Token oauth2.Token `datastore:",noindex"`
+  CreatedAt time.Time `datastore:",noindex"`
+}
+
+// Keeps the ID and the token out of the logs.
+func (s Session) String() string {
+  return fmt.Sprintf("{AccountId:%s AccountIds:%v Expiry:%v CreatedAt:%v}", s.AccountId, s.AccountIds, s.Token.Expiry, s.CreatedAt)
+}
+
+type SessionStore interface {
+  // Returns errSessionNotFound if there is no session |id|.
+  Get(id string) (*Session, error)
+  Put(id string, session *Session) error
+  Delete(id string) error
+}
+
+// The store used by the handlers, see main.
+var sessionStore SessionStore = &datastoreSessionStore{}
+
+// Sessions are stored in Datastore, keyed by their ID.
+const kSessionTable string = "Session"
+
+type datastoreSessionStore struct {}
+
+func (s *datastoreSessionStore) Get(id string) (*Session, error) {
+  ctx := context.Background()
+  client, err := getDatastoreClient()
+  if err != nil {
+    return nil, err
+  }
+
+  session := new(Session)
+  k := datastore.NameKey(kSessionTable, id, nil)
+  err = client.Get(ctx, k, session)
+  if err == datastore.ErrNoSuchEntity {
+    return nil, errSessionNotFound
+  }
+  if err != nil {
+    return nil, err
+  }
+  session.Id = id
+  return session, nil
+}
+
+func (s *datastoreSessionStore) Put(id string, session *Session) error {
+  ctx := context.Background()
+  client, err := getDatastoreClient()
+  if err != nil {
+    return err
+  }
+
+  k := datastore.NameKey(kSessionTable, id, nil)
+  _, err = client.Put(ctx, k, session)
+  return err
+}
+
+func (s *datastoreSessionStore) Delete(id string) error {
+  ctx := context.Background()
+  client, err := getDatastoreClient()
+  if err != nil {
+    return err
+  }
+
+  return client.Delete(ctx, datastore.NameKey(kSessionTable, id, nil))
+}
+
+// Keeps the sessions in memory. Used with the fake broker.
+type memorySessionStore struct {
+  mutex sync.Mutex
+  sessions map[string]Session
+}
+
+func newMemorySessionStore() *memorySessionStore {
+  return &memorySessionStore{
+    sessions: make(map[string]Session),
+  }
+}
+
+func (s *memorySessionStore) Get(id string) (*Session, error) {
+  s.mutex.Lock()
+  defer s.mutex.Unlock()
+
+  session, exists := s.sessions[id]
+  if !exists {
+    return nil, errSessionNotFound
+  }
+  session.Id = id
+  return &session, nil
+}
+
+func (s *memorySessionStore) Put(id string, session *Session) error {
+  s.mutex.Lock()
+  defer s.mutex.Unlock()
+
+  s.sessions[id] = *session
+  return nil
+}
+
+func (s *memorySessionStore) Delete(id string) error {
+  s.mutex.Lock()
+  defer s.mutex.Unlock()
+
+  delete(s.sessions, id)
+  return nil
+}
+
+// Returns 32 random bytes, base64 encoded so they can go in URLs and cookies.
+func newRandomString() (string, error) {
+  bytes := make([]byte, 32)
+  if _, err := rand.Read(bytes); err != nil {
+    return "", err
+  }
+  return base64.RawURLEncoding.EncodeToString(bytes), nil
+}
+
+func newSessionId() (string, error) {
+  return newRandomString()
+}
+
+// Returned by getSessionKey when AppSettings.SessionKey isn't set.
+var errMissingSessionKey = errors.New("No session key in the settings")
+
+// The key used to sign the LOGIN cookie, see getSessionKey.
+var (
+  sessionKeyMutex sync.Mutex
+  sessionKey []byte
+)
+
+// Returns the key from AppSettings.SessionKey.
+//
+// It is an error if it isn't set: a random key would silently log the users
+// out on every restart and break the logins across instances. The fake broker
+// is only used locally so it gets a random key instead.
+func getSessionKey() ([]byte, error) {
+  sessionKeyMutex.Lock()
+  defer sessionKeyMutex.Unlock()
+
+  if sessionKey != nil {
+    return sessionKey, nil
+  }
+
+  settings, err := getAppSettings()
+  if err != nil {
+    return nil, err
+  }
+  if settings.SessionKey != "" {
+    sessionKey = []byte(settings.SessionKey)
+    return sessionKey, nil
+  }
+
+  if fakeBrokerSettings == nil {
+    return nil, errMissingSessionKey
+  }
+
+  log.Printf("[INFO] No session key in the settings, using a random one for the fake broker")
+  key := make([]byte, 32)
+  if _, err := rand.Read(key); err != nil {
+    return nil, err
+  }
+  sessionKey = key
+  return sessionKey, nil
+}
+
+// Returns the signature of |value| with |key|.
+// The signing key is shared by all the cookies we need to trust.
+func signValue(key []byte, value string) string {
+  mac := hmac.New(sha256.New, key)
+  mac.Write([]byte(value))
+  return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// The cookie's value is "<session ID>.<signature>".
+func newSessionCookieValue(id string) (string, error) {
+  key, err := getSessionKey()
+  if err != nil {
+    return "", err
+  }
+  return id + "." + signValue(key, id), nil
+}
+
+// Returns the session ID in |value| if the signature matches.
+func parseSessionCookieValue(value string) (string, error) {
+  id, signature, found := strings.Cut(value, ".")
+  if !found {
+    return "", errInvalidSessionCookie
+  }
+
+  key, err := getSessionKey()
+  if err != nil {
+    return "", err
+  }
+  if !hmac.Equal([]byte(signature), []byte(signValue(key, id))) {
+    return "", errInvalidSessionCookie
+  }
+  return id, nil
+}
+
+// Whether |req| reached us over HTTPS.
+// App Engine terminates TLS in front of us and sets X-Forwarded-Proto.
+func isSecureRequest(req *http.Request) bool {
+  return req.TLS != nil || req.Header.Get("X-Forwarded-Proto") == "https"
+}
+
+// Stores a new session and sets the LOGIN cookie pointing to it.
+// |req| is the request we are answering.
+func startSession(w http.ResponseWriter, req *http.Request, session *Session) error {
+  id, err := newSessionId()
+  if err != nil {
+    return err
+  }
+  value, err := newSessionCookieValue(id)
+  if err != nil {
+    return err
+  }
+  session.Id = id
+  if err := sessionStore.Put(id, session); err != nil {
+    return err
+  }
+
+  http.SetCookie(w, &http.Cookie{
+    Name: kLoginCookieName,
+    Value: value,
+    Path: "/",
+    Expires: time.Now().Add(kSessionDuration),
+    HttpOnly: true,
+    Secure: isSecureRequest(req),
+    // Lax so the cookie is sent when the broker redirects back to us.
+    SameSite: http.SameSiteLaxMode,
+  })
+  return nil
+}
+
+// Returns the session of the user that made |req|.
+func getLoginSession(req *http.Request) (*Session, error) {
+  loginCookie, err := req.Cookie(kLoginCookieName)
+  if err != nil {
+    // TODO: ErrNoCookie is emitted when not present.
+    log.Printf("[INFO] Couldn't get login cookie (err = %+v)", err)
+    return nil, err
+  }
+
+  id, err := parseSessionCookieValue(loginCookie.Value)
+  if err != nil {
+    log.Printf("[WARN] Rejected the login cookie (err = %+v)", err)
+    return nil, err
+  }
+
+  session, err := sessionStore.Get(id)
+  if err != nil {
+    log.Printf("[INFO] Couldn't get the session (err = %+v)", err)
+    return nil, err
+  }
+
+  // Don't rely on the browser dropping the cookie.
+  if time.Since(session.CreatedAt) > kSessionDuration {
+    log.Printf("[INFO] The session created at %v has expired", session.CreatedAt)
+    if err := sessionStore.Delete(id); err != nil {
+      log.Printf("[ERROR] Failed to delete the expired session (err = %+v)", err)
+    }
+    return nil, errSessionExpired
+  }
+  return session, nil
+}
+
+// Deletes the session of the user that made |req|, if any, and clears the
+// LOGIN cookie.
+func endSession(w http.ResponseWriter, req *http.Request) error {
+  http.SetCookie(w, &http.Cookie{
+    Name: kLoginCookieName,
+    Path: "/",
+    MaxAge: -1,
+    HttpOnly: true,
+    Secure: isSecureRequest(req),
+    SameSite: http.SameSiteLaxMode,
+  })
+
+  loginCookie, err := req.Cookie(kLoginCookieName)
+  if err != nil {
+    return nil
+  }
+  id, err := parseSessionCookieValue(loginCookie.Value)
+  if err != nil {
+    return nil
+  }
+  return sessionStore.Delete(id)
+}
+
+// Logs the user out. This is a POST so another site can't log the user out
+// with a link.
+func logoutHandler(w http.ResponseWriter, req *http.Request) {
+  logRequest(req)
+
+  if req.Method != http.MethodPost {
+    http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    return
+  }
+  if err := endSession(w, req); err != nil {
+    log.Printf("[ERROR] Failed to delete the session (err = %+v)", err)
+    http.Error(w, "Internal Error", http.StatusInternalServerError)
+    return
+  }
+  http.Redirect(w, req, "/", http.StatusSeeOther)
+}
+
+// Refreshes the token through |source| and saves the refreshed token in the session.
+type sessionTokenSource struct {
+  mutex sync.Mutex
+  session Session
+  source oauth2.TokenSource
+}
+
+func (s *sessionTokenSource) Token() (*oauth2.Token, error) {
+  s.mutex.Lock()
+  defer s.mutex.Unlock()
+
+  token, err := s.source.Token()
+  if err != nil {
+    log.Printf("[ERROR] Failed to refresh the token (err = %+v)", err)
+    // The broker rejected the refresh token (e.g. it expired or was revoked):
+    // the user must log in again.
+    var retrieveErr *oauth2.RetrieveError
+    if errors.As(err, &retrieveErr) {
+      return nil, fmt.Errorf("%w: %v", errNotLoggedIn, err)
+    }
+    return nil, err
+  }
+
+  if token.AccessToken != s.session.Token.AccessToken || !token.Expiry.Equal(s.session.Token.Expiry) {
+    log.Printf("[INFO] Refreshed the token, it now expires at %v", token.Expiry)
+    s.session.Token = *token
+    if err := saveSessionToken(s.session.Id, token); err != nil {
+      // The token is still valid so don't fail the call.
+      log.Printf("[ERROR] Failed to save the refreshed token (err = %+v)", err)
+    }
+  }
+  return token, nil
+}
+
+// Only updates the token so we don't overwrite other changes to the session.
+func saveSessionToken(id string, token *oauth2.Token) error {
+  session, err := sessionStore.Get(id)
+  if err != nil {
+    return err
+  }
+  session.Token = *token
+  return sessionStore.Put(id, session)
+}
+
+// Returns a client authenticated as the session's user.
+// The access token is refreshed when it expires.
+func newSessionClient(settings *AppSettings, session *Session) *http.Client {
+  ctx := context.Background()
+  source := &sessionTokenSource{
+    session: *session,
+    source: newOAuthConfig(settings).TokenSource(ctx, &session.Token),
+  }
+  return oauth2.NewClient(ctx, source)
+}
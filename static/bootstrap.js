@@ -1,27 +1,159 @@
+// The symbol is passed to the page's URL by the symbol form.
+const symbol = new URLSearchParams(window.location.search).get('symbol');
+
 // Dispatch mandatory calls early.
-var optionsPromise = fetch('/options');
+var optionsPromise = fetch(symbol ? '/options?symbol=' + encodeURIComponent(symbol) : '/options');
 var userInfoPromise = fetch('/user/info');
 
 function render() {
+  if (symbol) {
+    document.getElementById('symbol').value = symbol;
+  }
+
   Promise.all([optionsPromise, userInfoPromise]).then((responses) => {
     return Promise.all(
-      // TODO: Check that the response is fine (ok and status on the Response).
-      responses.map((response) => response.json())
+      responses.map((response) => {
+        if (!response.ok) {
+          // Our handlers return the error message as text.
+          return response.text().then((text) => { throw new Error(text); });
+        }
+        return response.json();
+      })
     );
   }).then((jsons) => {
     const option = jsons[0];
     const userInfo = jsons[1];
-    const loggedIn = !!userInfo.access_token;
-    const cash_available = userInfo.user_info.cash_available || null;
+    const loggedIn = userInfo.logged_in;
+    const cash_available = (userInfo.user_info && userInfo.user_info.cash_available) || null;
+    const selectedAccount = userInfo.user_info && userInfo.user_info.account_id;
+    const accounts = userInfo.accounts.map((account) => {
+      return { account_id: account.account_id, selected: account.account_id == selectedAccount };
+    });
 
     var template = document.getElementById('template').innerHTML;
-    var rendered = Mustache.render(template, { loggedIn: loggedIn, availableFortrading: cash_available, options: option.options, suggestions: option.suggestions });
+    var rendered = Mustache.render(template, { loggedIn: loggedIn, multipleAccounts: accounts.length > 1, accounts: accounts, availableFortrading: cash_available, symbol: option.quote.symbol, lastPrice: option.quote.lastPrice, options: option.options, suggestions: option.suggestions });
     document.getElementById('target').innerHTML = rendered;
+    if (loggedIn) {
+      renderOrders();
+    }
   })
   .catch((error) => {
     console.log('Failed loading options:' + error);
-    document.getElementById('target').innerHTML = "Error loading options... Try reloading. If it happens again, let us know!";
+    document.getElementById('target').innerText = "Error loading options: " + error.message + ". Try reloading. If it happens again, let us know!";
+  });
+}
+
+// Our handlers return the error message as text.
+function checkResponse(response) {
+  if (!response.ok) {
+    return response.text().then((text) => { throw new Error(text); });
+  }
+  return response;
+}
+
+function renderOrders() {
+  fetch('/orders').then(checkResponse).then((response) => response.json()).then((json) => {
+    const working = json.orders.filter((order) => order.status == 'WORKING');
+    var template = document.getElementById('orders-template').innerHTML;
+    document.getElementById('orders').innerHTML = Mustache.render(template, { orders: working });
+  })
+  .catch((error) => {
+    document.getElementById('orders').innerText = "Error loading orders: " + error.message;
+  });
+}
+
+function cancelOrder(button) {
+  fetch('/orders/' + button.dataset.orderId, { method: 'DELETE' }).then(checkResponse).then(renderOrders)
+  .catch((error) => {
+    alert('Failed to cancel the order: ' + error.message);
+  });
+}
+
+function replaceOrder(button) {
+  const limitPrice = parseFloat(button.parentElement.querySelector('.limit-price').value) || 0;
+  fetch('/orders/' + button.dataset.orderId, {
+    method: 'PUT',
+    headers: { 'Content-Type': 'application/json' },
+    body: JSON.stringify({ limitPrice: limitPrice }),
+  }).then(checkResponse).then(renderOrders)
+  .catch((error) => {
+    alert('Failed to replace the order: ' + error.message);
+  });
+}
+
+function postOrder(symbol, limitPrice, dryRun) {
+  return fetch('/orders', {
+    method: 'POST',
+    headers: { 'Content-Type': 'application/json' },
+    body: JSON.stringify({ optionSymbol: symbol, contracts: 1, limitPrice: limitPrice, dryRun: dryRun }),
+  }).then(checkResponse).then((response) => response.json());
+}
+
+// Previews the order and sends it once the user confirmed.
+function sell(button) {
+  const symbol = button.dataset.symbol;
+  const limitPrice = parseFloat(button.parentElement.querySelector('.limit-price').value) || 0;
+  postOrder(symbol, limitPrice, /*dryRun*/true).then((preview) => {
+    const order = preview.order;
+    if (!confirm('Sell ' + order.contracts + ' ' + order.optionSymbol + ' at ' + order.limitPrice + '?')) {
+      return;
+    }
+    return postOrder(symbol, order.limitPrice, /*dryRun*/false).then((placed) => {
+      alert('Placed order ' + placed.order.orderId);
+      renderOrders();
+    });
+  })
+  .catch((error) => {
+    alert('Failed to place the order: ' + error.message);
+  });
+}
+
+// Places the order on the ask side and lets the server lower its price until it fills.
+function walk(button) {
+  if (!confirm('Sell 1 ' + button.dataset.symbol + ', walking the price from the ask down to the bid?')) {
+    return;
+  }
+  fetch('/walks', {
+    method: 'POST',
+    headers: { 'Content-Type': 'application/json' },
+    body: JSON.stringify({ optionSymbol: button.dataset.symbol, contracts: 1 }),
+  }).then(checkResponse).then((response) => response.json()).then((walk) => {
+    alert('Walking order ' + walk.orderId + ' from ' + walk.limitPrice + ' down to ' + walk.params.floor);
+    renderOrders();
+  })
+  .catch((error) => {
+    alert('Failed to start the walk: ' + error.message);
+  });
+}
+
+// Selects the account for the session and reloads so everything targets it.
+function selectAccount(select) {
+  fetch('/accounts', {
+    method: 'PUT',
+    headers: { 'Content-Type': 'application/json' },
+    body: JSON.stringify({ account_id: select.value }),
+  }).then(checkResponse).then(() => window.location.reload())
+  .catch((error) => {
+    alert('Failed to select the account: ' + error.message);
   });
 }
 
 window.addEventListener('load', render);
+window.addEventListener('load', () => {
+  document.getElementById('target').addEventListener('click', (event) => {
+    if (event.target.classList.contains('sell')) {
+      sell(event.target);
+    } else if (event.target.classList.contains('walk')) {
+      walk(event.target);
+    } else if (event.target.classList.contains('cancel')) {
+      cancelOrder(event.target);
+    } else if (event.target.classList.contains('replace')) {
+      replaceOrder(event.target);
+    }
+  });
+  document.getElementById('target').addEventListener('change', (event) => {
+    if (event.target.id == 'account') {
+      selectAccount(event.target);
+    }
+  });
+});
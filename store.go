@@ -0,0 +1,166 @@
+package main
+
+import (
+  "bytes"
+  "context"
+  "encoding/gob"
+  "log"
+  "sync"
+
+  "cloud.google.com/go/datastore"
+)
+
+// The per user entities, like the users and the links from the accounts to
+// their user, are stored in a table keyed by their ID.
+
+type EntityStore interface {
+  // Loads the entity |id| in |table| into |dst|.
+  // Returns false if there is no such entity.
+  Get(table, id string, dst any) (bool, error)
+  // Runs |f| in a transaction: its writes are only saved if none of the
+  // entities it read changed in the meantime. |f| can be called more than once.
+  RunInTransaction(f func(tx EntityTransaction) error) error
+}
+
+type EntityTransaction interface {
+  // Same as EntityStore.Get. The writes of the transaction aren't visible.
+  Get(table, id string, dst any) (bool, error)
+  // Stores |src| as the entity |id| in |table| when the transaction commits.
+  Put(table, id string, src any) error
+}
+
+// The store used by the handlers, see main.
+var entityStore EntityStore = &datastoreEntityStore{}
+
+type datastoreEntityStore struct {}
+
+// Converts the error of a Datastore Get of an entity in |table| to the
+// return values of EntityStore.Get.
+func datastoreGetResult(table string, err error) (bool, error) {
+  if err == datastore.ErrNoSuchEntity {
+    return false, nil
+  }
+  if _, ok := err.(*datastore.ErrFieldMismatch); ok {
+    // The entity was saved with fields we don't have anymore.
+    log.Printf("[WARN] Ignoring mismatched fields in %s (err = %+v)", table, err)
+    return true, nil
+  }
+  if err != nil {
+    return false, err
+  }
+  return true, nil
+}
+
+func (s *datastoreEntityStore) Get(table, id string, dst any) (bool, error) {
+  ctx := context.Background()
+  client, err := getDatastoreClient()
+  if err != nil {
+    return false, err
+  }
+
+  k := datastore.NameKey(table, id, nil)
+  return datastoreGetResult(table, client.Get(ctx, k, dst))
+}
+
+func (s *datastoreEntityStore) RunInTransaction(f func(tx EntityTransaction) error) error {
+  ctx := context.Background()
+  client, err := getDatastoreClient()
+  if err != nil {
+    return err
+  }
+
+  _, err = client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+    return f(&datastoreEntityTransaction{tx})
+  })
+  return err
+}
+
+type datastoreEntityTransaction struct {
+  tx *datastore.Transaction
+}
+
+func (t *datastoreEntityTransaction) Get(table, id string, dst any) (bool, error) {
+  return datastoreGetResult(table, t.tx.Get(datastore.NameKey(table, id, nil), dst))
+}
+
+func (t *datastoreEntityTransaction) Put(table, id string, src any) error {
+  _, err := t.tx.Put(datastore.NameKey(table, id, nil), src)
+  return err
+}
+
+// Keeps the entities in memory. Used with the fake broker.
+//
+// The entities are gob-encoded so the callers get copies, like with Datastore.
+type memoryEntityStore struct {
+  mutex sync.Mutex
+  // Keyed by table, then ID.
+  entities map[string]map[string][]byte
+}
+
+func newMemoryEntityStore() *memoryEntityStore {
+  return &memoryEntityStore{
+    entities: make(map[string]map[string][]byte),
+  }
+}
+
+// Must be called with the mutex held.
+func (s *memoryEntityStore) get(table, id string, dst any) (bool, error) {
+  encoded, exists := s.entities[table][id]
+  if !exists {
+    return false, nil
+  }
+  if err := gob.NewDecoder(bytes.NewReader(encoded)).Decode(dst); err != nil {
+    return false, err
+  }
+  return true, nil
+}
+
+func (s *memoryEntityStore) Get(table, id string, dst any) (bool, error) {
+  s.mutex.Lock()
+  defer s.mutex.Unlock()
+
+  return s.get(table, id, dst)
+}
+
+// The transactions hold the mutex so they can't conflict.
+func (s *memoryEntityStore) RunInTransaction(f func(tx EntityTransaction) error) error {
+  s.mutex.Lock()
+  defer s.mutex.Unlock()
+
+  tx := &memoryEntityTransaction{store: s}
+  if err := f(tx); err != nil {
+    return err
+  }
+  for _, write := range tx.writes {
+    if s.entities[write.table] == nil {
+      s.entities[write.table] = make(map[string][]byte)
+    }
+    s.entities[write.table][write.id] = write.encoded
+  }
+  return nil
+}
+
+type memoryEntityWrite struct {
+  table string
+  id string
+  encoded []byte
+}
+
+// The writes are buffered so they are dropped if the transaction fails.
+type memoryEntityTransaction struct {
+  store *memoryEntityStore
+  writes []memoryEntityWrite
+}
+
+func (t *memoryEntityTransaction) Get(table, id string, dst any) (bool, error) {
+  return t.store.get(table, id, dst)
+}
+
+func (t *memoryEntityTransaction) Put(table, id string, src any) error {
+  var encoded bytes.Buffer
+  if err := gob.NewEncoder(&encoded).Encode(src); err != nil {
+    return err
+  }
+  t.writes = append(t.writes, memoryEntityWrite{table, id, encoded.Bytes()})
+  return nil
+}
@@ -0,0 +1,548 @@
+package main
+
+import (
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io/ioutil"
+  "log"
+  "math"
+  "net/http"
+  neturl "net/url"
+  "strconv"
+  "strings"
+  "time"
+
+  "golang.org/x/oauth2"
+)
+
+const (
+  kTDABaseURL string = "https://api.tdameritrade.com/v1"
+  kTDAAuthURL string = "https://auth.tdameritrade.com/auth"
+)
+
+// Broker implementation for TDAmeritrade.
+type tdaBroker struct {
+  baseURL string
+  apiKey string
+  // Authenticated client, nil if the user is not logged in.
+  client *http.Client
+}
+
+func newTDABroker(settings *AppSettings, client *http.Client) *tdaBroker {
+  return &tdaBroker{
+    baseURL: settingOrDefault(settings.APIBaseURL, kTDABaseURL),
+    apiKey: settings.TDAClientId,
+    client: client,
+  }
+}
+
+func tdaOAuthConfig(s *AppSettings) *oauth2.Config {
+  return &oauth2.Config{
+		ClientID: fmt.Sprintf("%s@AMER.OAUTHAP", s.TDAClientId),
+    // TDAmetridate doesn't have a secret....
+		ClientSecret: "",
+		Scopes: []string{},
+		Endpoint: oauth2.Endpoint{
+			TokenURL: settingOrDefault(s.TokenURL, kTDABaseURL + "/oauth2/token"),
+			AuthURL:  settingOrDefault(s.AuthURL, kTDAAuthURL),
+		},
+    RedirectURL: s.TDARedirectURL,
+	}
+}
+
+// Performs an authenticated GET to |url| and returns the body.
+// Non-2xx responses are returned as errors, see doAuthenticatedRequest.
+func (b *tdaBroker) authenticatedGet(url string) ([]byte, error) {
+  _, body, err := doAuthenticatedRequest(b.client, http.MethodGet, url, nil)
+  return body, err
+}
+
+// Quotes
+
+type tdaQuoteResponse map[string] Quote
+
+func (b *tdaBroker) GetQuote(symbol string) (*Quote, error) {
+  url := fmt.Sprintf("%s/marketdata/%s/quotes?apikey=%s", b.baseURL, neturl.PathEscape(symbol), b.apiKey)
+  resp, err := http.Get(url)
+  if err != nil {
+    return nil, err
+  }
+
+  defer resp.Body.Close()
+  body, err := ioutil.ReadAll(resp.Body)
+  if err != nil {
+    return nil, err
+  }
+
+  var quote_resp tdaQuoteResponse
+  err = json.Unmarshal(body, &quote_resp)
+  if err != nil {
+    return nil, err
+  }
+
+  quote, exists := quote_resp[symbol]
+  if !exists {
+    return nil, errUnknownSymbol
+  }
+
+  return &quote, nil
+}
+
+// Option chains
+
+func buildOptionURL(baseURL, symbol, apiKey, putCall string, params *ChainParams) string {
+  start, end := params.dateRange()
+  var builder strings.Builder
+  builder.Grow(100)
+  builder.WriteString(baseURL)
+  builder.WriteString("/marketdata/chains?apikey=")
+  builder.WriteString(apiKey)
+  builder.WriteString("&symbol=")
+  builder.WriteString(neturl.QueryEscape(symbol))
+  builder.WriteString("&contractType=")
+  builder.WriteString(putCall)
+  if params.StrikeCount > 0 {
+    builder.WriteString("&strikeCount=")
+    builder.WriteString(strconv.Itoa(params.StrikeCount))
+  }
+  builder.WriteString("&range=")
+  builder.WriteString(params.Range)
+  builder.WriteString("&fromDate=")
+  builder.WriteString(fmt.Sprintf("%d-%d-%d", start.Year(), start.Month(), start.Day()))
+  builder.WriteString("&toDate=")
+  builder.WriteString(fmt.Sprintf("%d-%d-%d", end.Year(), end.Month(), end.Day()))
+  return builder.String()
+}
+
+// TDA (and Schwab) sometimes return "NaN" strings for numbers.
+type tdaFloat float64
+
+func (f *tdaFloat) UnmarshalJSON(data []byte) error {
+  if string(data) == `"NaN"` {
+    *f = tdaFloat(math.NaN())
+    return nil
+  }
+
+  var value float64
+  if err := json.Unmarshal(data, &value); err != nil {
+    return err
+  }
+  *f = tdaFloat(value)
+  return nil
+}
+
+// Returns NaN if |value| is missing, see isMissingValue.
+func tdaValue(value *tdaFloat) float64 {
+  if value == nil {
+    return math.NaN()
+  }
+  return float64(*value)
+}
+
+// Same as tdaValue for percentages, returned as a fraction (e.g. 0.3 for 30).
+// The missing values are checked before scaling so the -999 sentinel stays
+// recognizable.
+func tdaPercentValue(value *tdaFloat) float64 {
+  percent := tdaValue(value)
+  if isMissingValue(percent) {
+    return percent
+  }
+  return percent / 100
+}
+
+type tdaOption struct {
+  Symbol string `json:"symbol"`
+  PutCall string `json:"putCall"`
+  Bid float64 `json:"bid"`
+  BidSize int `json:"bidSize"`
+  Ask float64 `json:"ask"`
+  AskSize int `json:"askSize"`
+  Mark float64 `json:"mark"`
+  OpenInterest int `json:"openInterest"`
+  TotalVolume int `json:"totalVolume"`
+  StrikePrice float64 `json:"strikePrice"`
+  DaysToExpiration int `json:"daysToExpiration"`
+  // The meaning of the values depends on the broker, see formatOptionMap.
+  ExpirationType string `json:"expirationType"`
+  Multiplier float64 `json:"multiplier"`
+  // True for the contracts adjusted after a corporate action (e.g. a split).
+  // They share the strikes of the standard ones.
+  NonStandard bool `json:"nonStandard"`
+
+  // These are nil when they are not in the response.
+  Delta *tdaFloat `json:"delta,omitempty"`
+  Gamma *tdaFloat `json:"gamma,omitempty"`
+  Theta *tdaFloat `json:"theta,omitempty"`
+  Vega *tdaFloat `json:"vega,omitempty"`
+  // This is a percentage.
+  Volatility *tdaFloat `json:"volatility,omitempty"`
+  TheoreticalOptionValue *tdaFloat `json:"theoreticalOptionValue,omitempty"`
+}
+
+type tdaOptionByPriceMap map[string][]tdaOption
+
+type tdaOptionByDateMap map[string]tdaOptionByPriceMap
+
+type tdaOptionChainResponse struct {
+  Symbol string `json:"symbol"`
+  Status string `json:"status"`
+  UnderlyingPrice float64 `json:"underlyingPrice"`
+  NumberOfContracts int `json:"numberOfContracts"`
+
+  PutExpDateMap tdaOptionByDateMap `json:"putExpDateMap"`
+  CallExpDateMap tdaOptionByDateMap `json:"callExpDateMap"`
+}
+
+// Returns the standard contract out of the ones sharing a strike, the first
+// one if none is.
+func pickStandardOption(options []tdaOption) tdaOption {
+  for _, option := range options {
+    if !option.NonStandard {
+      return option
+    }
+  }
+  return options[0]
+}
+
+// |monthlyExpirationType| is the broker's expirationType for the standard
+// monthly expirations. If it is empty, or the options don't have a type, the
+// monthlies are found from the dates.
+func formatOptionMap(dateMap tdaOptionByDateMap, size int, monthlyExpirationType string) []Option {
+  options := make([]Option, 0, size)
+  for expiration, optionsByPrice := range dateMap {
+    // Expiration contains the time and the days to expiration.
+    // We drop the latter part here.
+    expiration, _, _ := strings.Cut(expiration, ":")
+    for price, maybeOptions := range optionsByPrice {
+      if len(maybeOptions) == 0 {
+        log.Printf("[WARN] No option for: %s - %s", expiration, price)
+        continue
+      }
+      option := pickStandardOption(maybeOptions)
+
+      monthly := isMonthlyExpiration(expiration)
+      if monthlyExpirationType != "" && option.ExpirationType != "" {
+        monthly = option.ExpirationType == monthlyExpirationType
+      }
+
+      options = append(options, Option{
+        Symbol: option.Symbol,
+        PutCall: option.PutCall,
+        StrikePrice: option.StrikePrice,
+        Expiration: expiration,
+        MonthlyExpiration: monthly,
+        Bid: option.Bid,
+        BidSize: option.BidSize,
+        Ask: option.Ask,
+        AskSize: option.AskSize,
+        Mark: option.Mark,
+
+        OpenInterest: option.OpenInterest,
+        Volume: option.TotalVolume,
+        DaysToExpiration: option.DaysToExpiration,
+        Multiplier: option.Multiplier,
+        Delta: tdaValue(option.Delta),
+        Gamma: tdaValue(option.Gamma),
+        Theta: tdaValue(option.Theta),
+        Vega: tdaValue(option.Vega),
+        ImpliedVolatility: tdaPercentValue(option.Volatility),
+        TheoreticalValue: tdaValue(option.TheoreticalOptionValue),
+      })
+    }
+  }
+
+  return options
+}
+
+func formatResponse(response tdaOptionChainResponse, putCall, monthlyExpirationType string) ([]Option, error) {
+  switch(putCall) {
+  case PUT:
+    return formatOptionMap(response.PutExpDateMap, response.NumberOfContracts, monthlyExpirationType), nil
+  case CALL:
+    return formatOptionMap(response.CallExpDateMap, response.NumberOfContracts, monthlyExpirationType), nil
+  default:
+    panic("Unknown value for putCall: " + putCall)
+  }
+}
+
+func (b *tdaBroker) GetOptionChain(symbol, putCall string, params *ChainParams) ([]Option, error) {
+  url := buildOptionURL(b.baseURL, symbol, b.apiKey, putCall, params)
+  log.Printf("[INFO] Calling %s to get options", urlForLog(url))
+
+  resp, err := http.Get(url)
+  if err != nil {
+    return []Option{}, err
+  }
+
+  defer resp.Body.Close()
+  body, err := ioutil.ReadAll(resp.Body)
+  if err != nil {
+    return []Option{}, err
+  }
+
+  var option_response tdaOptionChainResponse
+  err = json.Unmarshal(body, &option_response)
+  if err != nil {
+    return []Option{}, err
+  }
+
+  if option_response.Status != "SUCCESS" {
+    return []Option{}, errors.New("Called failed")
+  }
+
+  // TDA doesn't document its expiration types so we use the dates.
+  return formatResponse(option_response, putCall, "")
+}
+
+// Accounts
+
+type tdaCurrentBalance struct {
+  CashAvailableForTrading float64 `json:"cashAvailableForTrading"`
+}
+
+type tdaInstrument struct {
+  AssetType string `json:"assetType"`
+  Symbol string `json:"symbol"`
+}
+
+// Schwab uses the same format for positions.
+type tdaPosition struct {
+  ShortQuantity float64 `json:"shortQuantity"`
+  LongQuantity float64 `json:"longQuantity"`
+  AveragePrice float64 `json:"averagePrice"`
+  MarketValue float64 `json:"marketValue"`
+  Instrument tdaInstrument `json:"instrument"`
+}
+
+func formatPositions(tdaPositions []tdaPosition) []Position {
+  positions := make([]Position, 0, len(tdaPositions))
+  for _, position := range tdaPositions {
+    var optionDetails *OptionDetails
+    if position.Instrument.AssetType == kAssetTypeOption {
+      var err error
+      optionDetails, err = parseOptionSymbol(position.Instrument.Symbol)
+      if err != nil {
+        // Still return the position as it counts toward the account's value.
+        log.Printf("[WARN] Failed to parse option position (err = %+v)", err)
+      }
+    }
+
+    positions = append(positions, Position{
+      Symbol: position.Instrument.Symbol,
+      AssetType: position.Instrument.AssetType,
+      Quantity: position.LongQuantity - position.ShortQuantity,
+      AveragePrice: position.AveragePrice,
+      MarketValue: position.MarketValue,
+      Option: optionDetails,
+    })
+  }
+  return positions
+}
+
+type tdaSecuritiesAccount struct {
+  AccountId string `json:"accountId"`
+  CurrentBalances tdaCurrentBalance `json:"currentbalances"`
+  Positions []tdaPosition `json:"positions"`
+}
+
+type tdaAccountInfoResponse struct {
+  SecuritiesAccount tdaSecuritiesAccount `json:"securitiesAccount"`
+  // Ignore all other fields
+}
+
+func (b *tdaBroker) GetAccountIds() ([]string, error) {
+  body, err := b.authenticatedGet(b.baseURL + "/accounts")
+  if err != nil {
+    return nil, err
+  }
+
+  var accounts []tdaAccountInfoResponse
+  err = json.Unmarshal(body, &accounts)
+  if err != nil {
+    log.Printf("[ERROR] Failed to parse the accounts response (err = %+v): %s", err, bodyForLog(body))
+    return nil, err
+  }
+
+  accountIds := make([]string, 0, len(accounts))
+  for _, account := range accounts {
+    accountIds = append(accountIds, account.SecuritiesAccount.AccountId)
+  }
+  return accountIds, nil
+}
+
+// Orders
+
+// Schwab uses the same format for orders.
+type tdaOrderInstrument struct {
+  Symbol string `json:"symbol"`
+  AssetType string `json:"assetType"`
+}
+
+type tdaOrderLeg struct {
+  Instruction string `json:"instruction"`
+  // The API returns fractional quantities (1.0).
+  Quantity float64 `json:"quantity"`
+  Instrument tdaOrderInstrument `json:"instrument"`
+}
+
+type tdaOrder struct {
+  OrderType string `json:"orderType"`
+  Session string `json:"session"`
+  Price float64 `json:"price"`
+  Duration string `json:"duration"`
+  OrderStrategyType string `json:"orderStrategyType"`
+  OrderLegCollection []tdaOrderLeg `json:"orderLegCollection"`
+
+  // Only set in the responses.
+  OrderId int64 `json:"orderId,omitempty"`
+  Status string `json:"status,omitempty"`
+  FilledQuantity float64 `json:"filledQuantity,omitempty"`
+  EnteredTime string `json:"enteredTime,omitempty"`
+}
+
+// We only place single leg orders so we ignore the other ones.
+func (o *tdaOrder) toOrder(accountId string) (Order, bool) {
+  if len(o.OrderLegCollection) != 1 {
+    return Order{}, false
+  }
+
+  leg := o.OrderLegCollection[0]
+  return Order{
+    OrderId: strconv.FormatInt(o.OrderId, 10),
+    AccountId: accountId,
+    Instruction: leg.Instruction,
+    OptionSymbol: leg.Instrument.Symbol,
+    Contracts: int(leg.Quantity),
+    LimitPrice: o.Price,
+    Duration: o.Duration,
+    Status: o.Status,
+    FilledContracts: int(o.FilledQuantity),
+    EnteredTime: o.EnteredTime,
+  }, true
+}
+
+func formatOrders(accountId string, tdaOrders []tdaOrder) []Order {
+  orders := make([]Order, 0, len(tdaOrders))
+  for _, tdaOrder := range tdaOrders {
+    if order, ok := tdaOrder.toOrder(accountId); ok {
+      orders = append(orders, order)
+    }
+  }
+  return orders
+}
+
+func parseOrder(accountId string, body []byte) (*Order, error) {
+  var tdaOrder tdaOrder
+  if err := json.Unmarshal(body, &tdaOrder); err != nil {
+    return nil, err
+  }
+  order, ok := tdaOrder.toOrder(accountId)
+  if !ok {
+    return nil, fmt.Errorf("Unsupported order with %d legs", len(tdaOrder.OrderLegCollection))
+  }
+  return &order, nil
+}
+
+func parseOrders(accountId string, body []byte) ([]Order, error) {
+  var tdaOrders []tdaOrder
+  if err := json.Unmarshal(body, &tdaOrders); err != nil {
+    log.Printf("[ERROR] Failed to parse the orders response (err = %+v): %s", err, bodyForLog(body))
+    return nil, err
+  }
+  return formatOrders(accountId, tdaOrders), nil
+}
+
+func newTDAOrder(order *Order) *tdaOrder {
+  return &tdaOrder{
+    OrderType: "LIMIT",
+    Session: "NORMAL",
+    Price: order.LimitPrice,
+    Duration: order.Duration,
+    OrderStrategyType: "SINGLE",
+    OrderLegCollection: []tdaOrderLeg{
+      {
+        Instruction: order.Instruction,
+        Quantity: float64(order.Contracts),
+        Instrument: tdaOrderInstrument{
+          Symbol: order.OptionSymbol,
+          AssetType: kAssetTypeOption,
+        },
+      },
+    },
+  }
+}
+
+// The order ID is only returned in the Location header: .../orders/<ID>.
+func orderIdFromLocation(resp *http.Response) (string, error) {
+  location := resp.Header.Get("Location")
+  index := strings.LastIndex(location, "/")
+  if index < 0 || index == len(location) - 1 {
+    return "", fmt.Errorf("No order ID in the location: %s", location)
+  }
+  return location[index + 1:], nil
+}
+
+func (b *tdaBroker) PlaceOrder(accountId string, order *Order) (string, error) {
+  url := fmt.Sprintf("%s/accounts/%s/orders", b.baseURL, neturl.PathEscape(accountId))
+  resp, _, err := doAuthenticatedRequest(b.client, http.MethodPost, url, newTDAOrder(order))
+  if err != nil {
+    return "", err
+  }
+  return orderIdFromLocation(resp)
+}
+
+func (b *tdaBroker) GetOrders(accountId string) ([]Order, error) {
+  // The API only accepts dates for the time range.
+  from := time.Now().AddDate(0, 0, -kOrdersLookbackDays).Format("2006-01-02")
+  url := fmt.Sprintf("%s/accounts/%s/orders?fromEnteredTime=%s", b.baseURL, neturl.PathEscape(accountId), from)
+  _, body, err := doAuthenticatedRequest(b.client, http.MethodGet, url, nil)
+  if err != nil {
+    return nil, err
+  }
+  return parseOrders(accountId, body)
+}
+
+func (b *tdaBroker) GetOrder(accountId, orderId string) (*Order, error) {
+  url := fmt.Sprintf("%s/accounts/%s/orders/%s", b.baseURL, neturl.PathEscape(accountId), neturl.PathEscape(orderId))
+  _, body, err := doAuthenticatedRequest(b.client, http.MethodGet, url, nil)
+  if err != nil {
+    return nil, err
+  }
+  return parseOrder(accountId, body)
+}
+
+func (b *tdaBroker) CancelOrder(accountId, orderId string) error {
+  url := fmt.Sprintf("%s/accounts/%s/orders/%s", b.baseURL, neturl.PathEscape(accountId), neturl.PathEscape(orderId))
+  _, _, err := doAuthenticatedRequest(b.client, http.MethodDelete, url, nil)
+  return err
+}
+
+func (b *tdaBroker) ReplaceOrder(accountId, orderId string, order *Order) (string, error) {
+  url := fmt.Sprintf("%s/accounts/%s/orders/%s", b.baseURL, neturl.PathEscape(accountId), neturl.PathEscape(orderId))
+  resp, _, err := doAuthenticatedRequest(b.client, http.MethodPut, url, newTDAOrder(order))
+  if err != nil {
+    return "", err
+  }
+  return orderIdFromLocation(resp)
+}
+
+func (b *tdaBroker) GetUserAccountInfo(accountId string) (*UserAccountInfo, error) {
+  // TODO: Add orders to the list of fields here.
+  url := fmt.Sprintf("%s/accounts/%s?fields=positions", b.baseURL, neturl.PathEscape(accountId))
+  body, err := b.authenticatedGet(url)
+  if err != nil {
+    return nil, err
+  }
+
+  var tdaAccountInfoResponse tdaAccountInfoResponse
+  err = json.Unmarshal(body, &tdaAccountInfoResponse)
+  if err != nil {
+    return nil, err
+  }
+
+  return &UserAccountInfo{
+    CashAvailableForTrading: tdaAccountInfoResponse.SecuritiesAccount.CurrentBalances.CashAvailableForTrading,
+    Positions: formatPositions(tdaAccountInfoResponse.SecuritiesAccount.Positions),
+  }, nil
+}
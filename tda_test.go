@@ -0,0 +1,96 @@
+package main
+
+import (
+  "encoding/json"
+  "net/http"
+  "net/http/httptest"
+  "testing"
+)
+
+func TestFormatOptionMapMissingVolatility(t *testing.T) {
+  var dateMap tdaOptionByDateMap
+  err := json.Unmarshal([]byte(`{
+    "2024-05-17:30": {
+      "31.0": [{"putCall": "PUT", "symbol": "WY_051724P31", "strikePrice": 31.0, "mark": 0, "volatility": -999.0, "delta": -999.0, "daysToExpiration": 30, "multiplier": 100.0}],
+      "32.0": [{"putCall": "PUT", "symbol": "WY_051724P32", "strikePrice": 32.0, "mark": 0.65, "volatility": 27.5, "delta": -0.3, "daysToExpiration": 30, "multiplier": 100.0}]
+    }
+  }`), &dateMap)
+  if err != nil {
+    t.Fatalf("Invalid chain: %v", err)
+  }
+
+  options := formatOptionMap(dateMap, 2, "")
+  byStrike := map[float64]Option{}
+  for _, option := range options {
+    byStrike[option.StrikePrice] = option
+  }
+  if iv := byStrike[32].ImpliedVolatility; iv != 0.275 {
+    t.Errorf("ImpliedVolatility = %v, want 0.275", iv)
+  }
+
+  // There is no mark to solve the volatility from.
+  option := byStrike[31]
+  if !isMissingValue(option.ImpliedVolatility) {
+    t.Fatalf("ImpliedVolatility = %v, want a missing value", option.ImpliedVolatility)
+  }
+  option.UnderlyingPrice = 33.2
+  priceOption(&option, kDefaultRiskFreeRate)
+  if !option.MissingGreeks || option.ImpliedVolatility != 0 || option.Delta != 0 {
+    t.Errorf("Unexpected greeks %+v", option)
+  }
+
+  // A delta of 0 must not pass the delta filters.
+  filters := defaultOptionFilters()
+  filters.MinOpenInterest = 0
+  filters.MinOutOfTheMoneyPercent = -100
+  if reason := filters.rejectionReason(option); reason != "" {
+    t.Errorf("Rejected without delta filters: %s", reason)
+  }
+  filters.MaxDelta = 0.3
+  if reason := filters.rejectionReason(option); reason == "" {
+    t.Errorf("Option without greeks passed the max delta filter")
+  }
+}
+
+func TestFormatOptionMapNonStandard(t *testing.T) {
+  var dateMap tdaOptionByDateMap
+  err := json.Unmarshal([]byte(`{
+    "2024-05-17:30": {
+      "31.0": [
+        {"putCall": "PUT", "symbol": "WY1_051724P31", "strikePrice": 31.0, "mark": 0.1, "daysToExpiration": 30, "multiplier": 100.0, "nonStandard": true},
+        {"putCall": "PUT", "symbol": "WY_051724P31", "strikePrice": 31.0, "mark": 0.4, "daysToExpiration": 30, "multiplier": 100.0, "nonStandard": false}
+      ],
+      "32.0": []
+    }
+  }`), &dateMap)
+  if err != nil {
+    t.Fatalf("Invalid chain: %v", err)
+  }
+
+  // The adjusted contract and the empty strike are skipped instead of panicking.
+  options := formatOptionMap(dateMap, 2, "")
+  if len(options) != 1 || options[0].Symbol != "WY_051724P31" {
+    t.Errorf("formatOptionMap = %+v, want only the standard WY_051724P31", options)
+  }
+}
+
+func TestTDAAccountErrors(t *testing.T) {
+  var paths []string
+  server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+    paths = append(paths, req.URL.EscapedPath())
+    w.WriteHeader(http.StatusUnauthorized)
+    w.Write([]byte(`{"error": "The access token being passed has expired or is invalid."}`))
+  }))
+  defer server.Close()
+
+  broker := newTDABroker(&AppSettings{APIBaseURL: server.URL}, http.DefaultClient)
+  if _, err := broker.GetUserAccountInfo("123/456"); err == nil {
+    t.Errorf("GetUserAccountInfo succeeded on a 401")
+  }
+  if _, err := broker.GetAccountIds(); err == nil {
+    t.Errorf("GetAccountIds succeeded on a 401")
+  }
+  if len(paths) == 0 || paths[0] != "/accounts/123%2F456" {
+    t.Errorf("Requested %v, want the account ID escaped", paths)
+  }
+}
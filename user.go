@@ -1,54 +1,85 @@
 package main
 
 import (
-  "encoding/json"
-  "fmt"
-  "io/ioutil"
-  "net/http"
+  "math"
 )
 
-type UserAccountInfo struct {
-  CashAvailableForTrading float64
-}
+const (
+  kAssetTypeEquity = "EQUITY"
+  kAssetTypeOption = "OPTION"
+)
 
-type tdaCurrentBalance struct {
-  CashAvailableForTrading float64 `json:"cashAvailableForTrading"`
-}
-type tdaSecuritiesAccount struct {
-  CurrentBalances tdaCurrentBalance `json:"currentbalances"`
+// A position held in the account.
+type Position struct {
+  Symbol string `json:"symbol"`
+  // One of the kAssetType constants (or whatever the broker returned).
+  AssetType string `json:"assetType"`
+  // Negative for short positions.
+  Quantity float64 `json:"quantity"`
+  // This is the cost basis per share (or per option).
+  AveragePrice float64 `json:"averagePrice"`
+  // Negative for short positions.
+  MarketValue float64 `json:"marketValue"`
+
+  // Only set for options.
+  Option *OptionDetails `json:"option,omitempty"`
 }
-type tdaAccountInfoResponse struct {
-  SecuritiesAccount tdaSecuritiesAccount `json:"securitiesAccount"`
+
+type UserAccountInfo struct {
+  CashAvailableForTrading float64
+  Positions []Position
 }
 
-func GetUserAccountInfo(accountId, accessToken string) (*UserAccountInfo, error) {
-  // TODO: Add orders to the list of fields here.
-  url := fmt.Sprintf("https://api.tdameritrade.com/v1/accounts/%s?fields=positions", accountId)
-  req, err := http.NewRequest("GET", url, nil)
-  if err != nil {
-    return nil, err
+// Returns the equity positions that could be covered by calls.
+func (info *UserAccountInfo) LongEquityPositions() []Position {
+  positions := []Position{}
+  for _, position := range info.Positions {
+    if position.AssetType == kAssetTypeEquity && position.Quantity > 0 {
+      positions = append(positions, position)
+    }
   }
+  return positions
+}
 
-  req.Header.Add("Authorization", "Bearer " + accessToken)
+// Positions and orders don't have the options' multiplier. The equity options
+// we trade are standard contracts of 100 shares.
+const kSharesPerContract = 100
 
-  client := &http.Client{}
-  resp, err := client.Do(req)
-  if err != nil {
-    return nil, err
-  }
-  defer resp.Body.Close()
-  body, err := ioutil.ReadAll(resp.Body)
-  if err != nil {
-    return nil, err
+// Returns the shares of |symbol| that are free to be covered by a new call:
+// the long shares minus the ones already covered by short calls and by the
+// open sell-to-open call |orders|.
+func (info *UserAccountInfo) UncoveredShares(symbol string, orders []Order) float64 {
+  shares := 0.
+  for _, position := range info.Positions {
+    switch {
+    case position.AssetType == kAssetTypeEquity && position.Symbol == symbol && position.Quantity > 0:
+      shares += position.Quantity
+    case position.Option != nil && position.Option.Underlying == symbol && position.Option.PutCall == CALL && position.Quantity < 0:
+      shares += position.Quantity * kSharesPerContract
+    }
   }
 
-  var tdaAccountInfoResponse tdaAccountInfoResponse
-  err = json.Unmarshal(body, &tdaAccountInfoResponse)
-  if err != nil {
-    return nil, err
+  for _, order := range orders {
+    if !order.IsOpen() || order.Instruction != kSellToOpen {
+      continue
+    }
+    details, err := parseOptionSymbol(order.OptionSymbol)
+    if err != nil || details.Underlying != symbol || details.PutCall != CALL {
+      continue
+    }
+    // The filled contracts are already in the positions.
+    shares -= float64(order.Contracts - order.FilledContracts) * kSharesPerContract
   }
+  return math.Max(shares, 0)
+}
 
-  return &UserAccountInfo{
-    CashAvailableForTrading: tdaAccountInfoResponse.SecuritiesAccount.CurrentBalances.CashAvailableForTrading,
-  }, nil
+// Returns the option positions.
+func (info *UserAccountInfo) OptionPositions() []Position {
+  positions := []Position{}
+  for _, position := range info.Positions {
+    if position.Option != nil {
+      positions = append(positions, position)
+    }
+  }
+  return positions
 }
@@ -0,0 +1,409 @@
+package main
+
+import (
+  "context"
+  "encoding/json"
+  "fmt"
+  "io/ioutil"
+  "log"
+  "math"
+  "net/http"
+  "sort"
+  "strings"
+  "sync"
+  "time"
+)
+
+// Selling premium at Mark often doesn't fill.
+//
+// A walk places a sell-to-open order on the ask side of the mid and lowers
+// its limit price by a step at a fixed interval until it fills or reaches a
+// floor (the bid by default). Each walk runs in its own goroutine and every
+// replace is logged.
+//
+// The walks are kept in memory so they stop if the server restarts. The
+// order is then left working at its last price. Finished walks are dropped
+// after kWalkTTL.
+
+const (
+  kDefaultWalkStep = 0.05
+  kDefaultWalkIntervalSeconds = 60
+  // Keep us well under the broker's rate limits.
+  kMinWalkIntervalSeconds = 5
+  // How many times in a row a step can fail on a transient error (see
+  // isTransient) before giving up. The step is retried at the next interval.
+  kMaxWalkRetries = 3
+)
+
+// How long we keep the walks once they are over.
+const kWalkTTL = 24 * time.Hour
+
+// Values for orderWalk.Status.
+const (
+  kWalkWalking = "WALKING"
+  kWalkFilled = "FILLED"
+  // The order is left working at the floor.
+  kWalkFloorReached = "FLOOR_REACHED"
+  kWalkCancelled = "CANCELLED"
+  // The order was closed outside of the walk, e.g. cancelled in the broker's UI.
+  kWalkStopped = "STOPPED"
+  kWalkFailed = "FAILED"
+)
+
+type WalkParams struct {
+  // How much the limit price is lowered at each interval.
+  Step float64 `json:"step"`
+  IntervalSeconds int `json:"intervalSeconds"`
+  // The lowest limit price. Defaults to the bid.
+  Floor float64 `json:"floor"`
+}
+
+type walkLogEntry struct {
+  Time time.Time `json:"time"`
+  OrderId string `json:"orderId"`
+  LimitPrice float64 `json:"limitPrice"`
+  Message string `json:"message"`
+}
+
+// The state of a walk, as returned by the handlers.
+type walkState struct {
+  // The ID of the first order. The replaces get new IDs.
+  Id string `json:"id"`
+  AccountId string `json:"accountId"`
+  OptionSymbol string `json:"optionSymbol"`
+  Params WalkParams `json:"params"`
+
+  // The order being walked.
+  OrderId string `json:"orderId"`
+  LimitPrice float64 `json:"limitPrice"`
+  Status string `json:"status"`
+  Log []walkLogEntry `json:"log"`
+}
+
+type orderWalk struct {
+  // Protects the state. It is held during the broker calls changing the
+  // order so stopping the walk can't race with a replace.
+  mutex sync.Mutex
+  walkState
+
+  broker Broker
+  cancel context.CancelFunc
+  // The consecutive transient errors.
+  failures int
+  // Set once the walk is over.
+  finishedAt time.Time
+}
+
+// All the walks, keyed by ID.
+var walksMutex sync.Mutex
+var walks = make(map[string]*orderWalk)
+
+// Must be called with the walk's mutex held.
+func (walk *orderWalk) addLog(format string, args ...any) {
+  entry := walkLogEntry{
+    Time: time.Now(),
+    OrderId: walk.OrderId,
+    LimitPrice: walk.LimitPrice,
+    Message: fmt.Sprintf(format, args...),
+  }
+  walk.Log = append(walk.Log, entry)
+  log.Printf("[INFO] Walk %s: order %s at %.2f: %s", walk.Id, entry.OrderId, entry.LimitPrice, entry.Message)
+}
+
+// Must be called with the walk's mutex held.
+func (walk *orderWalk) finish(status, format string, args ...any) {
+  walk.Status = status
+  walk.finishedAt = time.Now()
+  walk.addLog(format, args...)
+}
+
+// Fails the walk unless |err| is transient, in which case the step is
+// retried at the next interval up to kMaxWalkRetries times.
+// Returns false if the walk is over.
+// Must be called with the walk's mutex held.
+func (walk *orderWalk) fail(err error, format string, args ...any) bool {
+  walk.failures++
+  if isTransient(err) && walk.failures <= kMaxWalkRetries {
+    walk.addLog(format + ", retrying: %v", append(args, err)...)
+    return true
+  }
+  walk.finish(kWalkFailed, format + ": %v", append(args, err)...)
+  return false
+}
+
+// Drops the walks that have been over for more than kWalkTTL.
+// Must be called with walksMutex held.
+func pruneWalks() {
+  for id, walk := range walks {
+    walk.mutex.Lock()
+    expired := walk.Status != kWalkWalking && time.Since(walk.finishedAt) > kWalkTTL
+    walk.mutex.Unlock()
+    if expired {
+      delete(walks, id)
+    }
+  }
+}
+
+func (walk *orderWalk) snapshot() walkState {
+  walk.mutex.Lock()
+  defer walk.mutex.Unlock()
+
+  state := walk.walkState
+  state.Log = append([]walkLogEntry{}, walk.Log...)
+  return state
+}
+
+// Performs a single step of the walk.
+// Returns false once the walk is over.
+func (walk *orderWalk) step() bool {
+  walk.mutex.Lock()
+  defer walk.mutex.Unlock()
+
+  // The walk could have been stopped while we were waiting for the ticker.
+  if walk.Status != kWalkWalking {
+    return false
+  }
+
+  order, err := walk.broker.GetOrder(walk.AccountId, walk.OrderId)
+  if err != nil {
+    return walk.fail(err, "Failed to get the order")
+  }
+  if order.Status == kOrderFilled {
+    walk.finish(kWalkFilled, "Filled")
+    return false
+  }
+  if !order.IsOpen() {
+    walk.finish(kWalkStopped, "Order is %s", order.Status)
+    return false
+  }
+  if walk.LimitPrice <= walk.Params.Floor {
+    walk.finish(kWalkFloorReached, "Reached the floor, leaving the order working")
+    return false
+  }
+
+  // Rounding down guarantees we move by at least a tick.
+  nextPrice := math.Max(floorToTick(walk.LimitPrice - walk.Params.Step), walk.Params.Floor)
+  newOrder, err := replaceOrderPrice(walk.broker, walk.AccountId, walk.OrderId, nextPrice)
+  if err != nil {
+    return walk.fail(err, "Failed to replace the order")
+  }
+  walk.failures = 0
+
+  replacedOrderId := walk.OrderId
+  walk.OrderId = newOrder.OrderId
+  walk.LimitPrice = newOrder.LimitPrice
+  walk.addLog("Replaced order %s", replacedOrderId)
+  if newOrder.Status == kOrderFilled {
+    walk.finish(kWalkFilled, "Filled")
+    return false
+  }
+  return true
+}
+
+func (walk *orderWalk) run(ctx context.Context) {
+  ticker := time.NewTicker(time.Duration(walk.Params.IntervalSeconds) * time.Second)
+  defer ticker.Stop()
+
+  for {
+    select {
+    case <-ctx.Done():
+      return
+    case <-ticker.C:
+      if !walk.step() {
+        return
+      }
+    }
+  }
+}
+
+// Stops the walk and cancels its order.
+func (walk *orderWalk) stop() error {
+  walk.mutex.Lock()
+  defer walk.mutex.Unlock()
+
+  if walk.Status != kWalkWalking {
+    return &invalidOrderError{fmt.Sprintf("Walk %s is %s", walk.Id, walk.Status)}
+  }
+  walk.cancel()
+
+  if err := cancelOrder(walk.broker, walk.AccountId, walk.OrderId); err != nil {
+    walk.finish(kWalkFailed, "Failed to cancel the order: %v", err)
+    return err
+  }
+  walk.finish(kWalkCancelled, "Cancelled")
+  return nil
+}
+
+type startWalkRequest struct {
+  OptionSymbol string `json:"optionSymbol"`
+  Contracts int `json:"contracts"`
+  WalkParams
+}
+
+// Places the order for |walkReq| and starts walking it.
+func startWalk(broker Broker, accountId string, walkReq *startWalkRequest, riskFreeRate, cashReservePercent float64) (*orderWalk, error) {
+  params := walkReq.WalkParams
+  if params.Step == 0 {
+    params.Step = kDefaultWalkStep
+  }
+  if params.IntervalSeconds == 0 {
+    params.IntervalSeconds = kDefaultWalkIntervalSeconds
+  }
+  if params.Step < 0.01 {
+    return nil, &invalidOrderError{"step must be at least 0.01"}
+  }
+  if params.IntervalSeconds < kMinWalkIntervalSeconds {
+    return nil, &invalidOrderError{fmt.Sprintf("intervalSeconds must be at least %d", kMinWalkIntervalSeconds)}
+  }
+
+  option, err := lookupOption(broker, walkReq.OptionSymbol, riskFreeRate)
+  if err != nil {
+    return nil, err
+  }
+
+  mid := (option.Bid + option.Ask) / 2
+  startPrice := roundToTick((mid + option.Ask) / 2)
+  if params.Floor == 0 {
+    params.Floor = option.Bid
+  }
+  params.Floor = roundToTick(params.Floor)
+  if params.Floor <= 0 || params.Floor > startPrice {
+    return nil, &invalidOrderError{fmt.Sprintf("floor must be between 0 and the starting price %.2f", startPrice)}
+  }
+
+  orderReq := &placeOrderRequest{
+    OptionSymbol: walkReq.OptionSymbol,
+    Contracts: walkReq.Contracts,
+    LimitPrice: startPrice,
+  }
+  placed, err := sellToOpen(broker, accountId, option, orderReq, cashReservePercent)
+  if err != nil {
+    return nil, err
+  }
+
+  ctx, cancel := context.WithCancel(context.Background())
+  walk := &orderWalk{
+    walkState: walkState{
+      Id: placed.Order.OrderId,
+      AccountId: accountId,
+      OptionSymbol: option.Symbol,
+      Params: params,
+      OrderId: placed.Order.OrderId,
+      LimitPrice: placed.Order.LimitPrice,
+      Status: kWalkWalking,
+    },
+    broker: broker,
+    cancel: cancel,
+  }
+  walk.addLog("Placed order, walking down to %.2f", params.Floor)
+
+  walksMutex.Lock()
+  pruneWalks()
+  walks[walk.Id] = walk
+  walksMutex.Unlock()
+
+  go walk.run(ctx)
+  return walk, nil
+}
+
+// Returns the walk |walkId| if it belongs to |accountId|.
+func getWalk(accountId, walkId string) *orderWalk {
+  walksMutex.Lock()
+  defer walksMutex.Unlock()
+
+  walk := walks[walkId]
+  if walk == nil || walk.AccountId != accountId {
+    return nil
+  }
+  return walk
+}
+
+type walksHandlerResponse struct {
+  Walks []walkState `json:"walks"`
+}
+
+// Handles /walks and /walks/<walkId> for the logged in user:
+//   GET /walks lists the walks, most recent first.
+//   POST /walks places an order and starts walking it.
+//   GET /walks/<walkId> returns the walk with its log.
+//   DELETE /walks/<walkId> stops the walk and cancels its order.
+func walksHandler(w http.ResponseWriter, req *http.Request) {
+  logRequest(req)
+
+  session, accountId := getRequestAccount(w, req)
+  if session == nil {
+    return
+  }
+
+  walkId := strings.Trim(strings.TrimPrefix(req.URL.Path, "/walks"), "/")
+  if walkId != "" {
+    walk := getWalk(accountId, walkId)
+    if walk == nil {
+      http.Error(w, "Unknown walk", http.StatusNotFound)
+      return
+    }
+
+    switch req.Method {
+    case http.MethodGet:
+      writeJSON(w, walk.snapshot())
+    case http.MethodDelete:
+      if err := walk.stop(); err != nil {
+        writeOrderError(w, err)
+        return
+      }
+      writeJSON(w, walk.snapshot())
+    default:
+      http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    }
+    return
+  }
+
+  switch req.Method {
+  case http.MethodGet:
+    walksMutex.Lock()
+    pruneWalks()
+    accountWalks := []*orderWalk{}
+    for _, walk := range walks {
+      if walk.AccountId == accountId {
+        accountWalks = append(accountWalks, walk)
+      }
+    }
+    walksMutex.Unlock()
+
+    resp := walksHandlerResponse{Walks: []walkState{}}
+    for _, walk := range accountWalks {
+      resp.Walks = append(resp.Walks, walk.snapshot())
+    }
+    sort.Slice(resp.Walks, func(i, j int) bool {
+      return resp.Walks[i].Log[0].Time.After(resp.Walks[j].Log[0].Time)
+    })
+    writeJSON(w, resp)
+  case http.MethodPost:
+    settings, err := getAppSettings()
+    if err != nil {
+      log.Printf("[ERROR] Failed getting the app settings (err = %+v)", err)
+      http.Error(w, "Internal Error", http.StatusInternalServerError)
+      return
+    }
+
+    body, err := ioutil.ReadAll(req.Body)
+    if err != nil {
+      http.Error(w, "Couldn't read body", http.StatusBadRequest)
+      return
+    }
+    walkReq := new(startWalkRequest)
+    if err := json.Unmarshal(body, walkReq); err != nil {
+      http.Error(w, "Invalid walk", http.StatusBadRequest)
+      return
+    }
+
+    walk, err := startWalk(getBroker(settings, session), accountId, walkReq, settings.riskFreeRate(), getSessionPreferences(session).CashReservePercent)
+    if err != nil {
+      writeOrderError(w, err)
+      return
+    }
+    writeJSON(w, walk.snapshot())
+  default:
+    http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+  }
+}
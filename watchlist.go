@@ -0,0 +1,247 @@
+package main
+
+import (
+  "encoding/json"
+  "errors"
+  "io/ioutil"
+  "log"
+  "net/http"
+  "strings"
+  "sync"
+)
+
+// Upper bound on the watchlist size to keep the scans reasonable.
+const kMaxWatchlistSize = 50
+
+// The watchlist is part of the user's preferences, see Preferences.Watchlist.
+type Watchlist struct {
+  Symbols []string `json:"symbols"`
+}
+
+// Normalizes and deduplicates |symbols|.
+// Returns false if any of them is invalid.
+func normalizeSymbols(symbols []string) ([]string, bool) {
+  seen := make(map[string]bool, len(symbols))
+  normalized := make([]string, 0, len(symbols))
+  for _, symbol := range symbols {
+    symbol, valid := normalizeSymbol(symbol)
+    if !valid {
+      return nil, false
+    }
+    if seen[symbol] {
+      continue
+    }
+    seen[symbol] = true
+    normalized = append(normalized, symbol)
+  }
+  return normalized, true
+}
+
+// GET returns the watchlist of the logged in user, PUT replaces it.
+func watchlistHandler(w http.ResponseWriter, req *http.Request) {
+  logRequest(req)
+
+  session, err := getLoginSession(req)
+  if err != nil {
+    http.Error(w, "Login required", http.StatusUnauthorized)
+    return
+  }
+
+  switch req.Method {
+  case http.MethodGet:
+    preferences, err := getUserPreferences(session.userId())
+    if err != nil {
+      log.Printf("[ERROR] Failed to get the watchlist (err = %+v)", err)
+      http.Error(w, "Internal Error", http.StatusInternalServerError)
+      return
+    }
+    watchlist := &Watchlist{Symbols: preferences.Watchlist}
+    if watchlist.Symbols == nil {
+      watchlist.Symbols = []string{}
+    }
+    writeJSON(w, watchlist)
+  case http.MethodPut:
+    body, err := ioutil.ReadAll(req.Body)
+    if err != nil {
+      http.Error(w, "Couldn't read body", http.StatusBadRequest)
+      return
+    }
+
+    watchlist := new(Watchlist)
+    if err := json.Unmarshal(body, watchlist); err != nil {
+      http.Error(w, "Invalid watchlist", http.StatusBadRequest)
+      return
+    }
+
+    symbols, valid := normalizeSymbols(watchlist.Symbols)
+    if !valid {
+      http.Error(w, "Invalid symbol in watchlist", http.StatusBadRequest)
+      return
+    }
+    if len(symbols) > kMaxWatchlistSize {
+      http.Error(w, "Too many symbols in watchlist", http.StatusBadRequest)
+      return
+    }
+    watchlist.Symbols = symbols
+
+    _, err = updateUserPreferences(session.userId(), func(preferences *Preferences) {
+      preferences.Watchlist = symbols
+    })
+    if err != nil {
+      log.Printf("[ERROR] Failed to save the watchlist (err = %+v)", err)
+      http.Error(w, "Internal Error", http.StatusInternalServerError)
+      return
+    }
+    writeJSON(w, watchlist)
+  default:
+    http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+  }
+}
+
+// Scanning
+
+type scanResult struct {
+  symbol string
+  quote *Quote
+  options []Option
+  err error
+}
+
+// How many symbols are fetched at the same time.
+// This keeps us under the broker's rate limits with a big watchlist.
+const kScanWorkers = 6
+
+// Fetches the quotes and chains for all |symbols| concurrently.
+// The results are in the same order as |symbols|.
+func scanSymbols(broker Broker, symbols []string, putCall string, chainParams *ChainParams, riskFreeRate float64) []scanResult {
+  results := make([]scanResult, len(symbols))
+  indices := make(chan int)
+  var wg sync.WaitGroup
+  for worker := 0; worker < min(kScanWorkers, len(symbols)); worker++ {
+    wg.Add(1)
+    go func() {
+      defer wg.Done()
+      for i := range indices {
+        quote, options, err := getSymbolOptions(broker, symbols[i], putCall, chainParams, riskFreeRate)
+        results[i] = scanResult{
+          symbol: symbols[i],
+          quote: quote,
+          options: options,
+          err: err,
+        }
+      }
+    }()
+  }
+  for i := range symbols {
+    indices <- i
+  }
+  close(indices)
+  wg.Wait()
+  return results
+}
+
+type scanHandlerResponse struct {
+  Quotes map[string]Quote `json:"quotes"`
+  // The suggestions across all the symbols, best first.
+  // Option.Underlying tells which symbol each came from.
+  Suggestions []Option `json:"suggestions"`
+  // The cash usable as collateral, null if not logged in.
+  CashAvailable *float64 `json:"cashAvailable"`
+  // The options that were filtered out, annotated with the reason.
+  Rejected []Option `json:"rejected"`
+  // The symbols we couldn't scan with the reason.
+  Errors map[string]string `json:"errors"`
+}
+
+// Scans the watchlist (or the comma-separated |symbols| parameter) for puts to sell.
+func scanHandler(w http.ResponseWriter, req *http.Request) {
+  logRequest(req)
+
+  settings, err := getAppSettings()
+  if err != nil {
+    log.Printf("[ERROR] Failed getting the app settings (err = %+v)", err)
+    http.Error(w, "Internal Error", http.StatusInternalServerError)
+    return
+  }
+
+  session, accountId, ok := getOptionalRequestAccount(w, req)
+  if !ok {
+    return
+  }
+
+  preferences := getSessionPreferences(session)
+  params, err := getSuggestionParams(req, preferences)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusBadRequest)
+    return
+  }
+  chainParams, err := getRequestChainParams(req, preferences)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusBadRequest)
+    return
+  }
+
+  var symbols []string
+  if symbolsParam := req.URL.Query().Get("symbols"); symbolsParam != "" {
+    symbols = strings.Split(symbolsParam, ",")
+  } else {
+    if session == nil {
+      http.Error(w, "Login required to scan the watchlist", http.StatusUnauthorized)
+      return
+    }
+
+    symbols = preferences.Watchlist
+  }
+
+  symbols, valid := normalizeSymbols(symbols)
+  if !valid {
+    http.Error(w, "Invalid symbol", http.StatusBadRequest)
+    return
+  }
+  if len(symbols) > kMaxWatchlistSize {
+    http.Error(w, "Too many symbols", http.StatusBadRequest)
+    return
+  }
+
+  broker := getBroker(settings, session)
+  results := scanSymbols(broker, symbols, PUT, chainParams, settings.riskFreeRate())
+
+  resp := scanHandlerResponse{
+    Quotes: make(map[string]Quote, len(symbols)),
+    Errors: make(map[string]string),
+  }
+  var options []Option
+  for _, result := range results {
+    if errors.Is(result.err, errNotLoggedIn) {
+      http.Error(w, "Login required", http.StatusUnauthorized)
+      return
+    }
+    if errors.Is(result.err, errUnknownSymbol) {
+      resp.Errors[result.symbol] = "Unknown symbol"
+      continue
+    }
+    if result.err != nil {
+      log.Printf("[ERROR] Failed to get options for symbol %s (err = %+v)", result.symbol, result.err)
+      resp.Errors[result.symbol] = "Failed to get the options"
+      continue
+    }
+
+    resp.Quotes[result.symbol] = *result.quote
+    options = append(options, result.options...)
+  }
+
+  if err := params.setBalanceFromAccount(broker, accountId); err != nil {
+    writeBrokerError(w, err, "get the account balance")
+    return
+  }
+  resp.Suggestions = FilterOptions(options, params)
+  setRiskMetrics(resp.Suggestions, settings.riskFreeRate(), settings.expectedReturn())
+  resp.CashAvailable = params.balanceForResponse()
+  resp.Rejected = []Option{}
+  for _, option := range options {
+    if option.RejectionReason != "" {
+      resp.Rejected = append(resp.Rejected, option)
+    }
+  }
+  writeJSON(w, resp)
+}